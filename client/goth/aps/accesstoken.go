@@ -0,0 +1,42 @@
+package aps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOpaqueAccessToken is returned by DecodeAccessToken for an access token
+// that is not a JWT, which only the server can interpret.
+var ErrOpaqueAccessToken = errors.New("access token is not a JWT")
+
+// DecodeAccessToken returns the claims of a JWT access token, such as its
+// scope or roles, for authorization decisions without an introspection
+// request. The signature is verified when a JWKS URL is configured or the
+// token's issuer is trusted; otherwise the claims are returned unverified,
+// and anyone could have forged them. An expired token is rejected. Opaque
+// tokens fail with ErrOpaqueAccessToken.
+func (p *Provider) DecodeAccessToken(token string) (map[string]interface{}, error) {
+	if _, err := parseJWT(token); err != nil {
+		return nil, ErrOpaqueAccessToken
+	}
+	t, err := p.verifyJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(t.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed access token claims: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		skew := defaultClockSkew
+		if p.clockSkew != nil {
+			skew = *p.clockSkew
+		}
+		if expiry := time.Unix(int64(exp), 0); nowFunc().Add(-skew).After(expiry) {
+			return nil, fmt.Errorf("access token expired at %s", expiry.UTC())
+		}
+	}
+	return claims, nil
+}
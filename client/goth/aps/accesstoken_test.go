@@ -0,0 +1,44 @@
+package aps
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestDecodeAccessToken(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+	defer jwks.Close()
+	valid := map[string]interface{}{"sub": "1", "scope": "read", "exp": now.Add(time.Hour).Unix()}
+	expired := map[string]interface{}{"sub": "1", "exp": now.Add(-time.Hour).Unix()}
+
+	for _, tt := range []struct {
+		name   string
+		jwks   bool
+		token  string
+		opaque bool
+		ok     bool
+	}{
+		{"opaque", true, "2YotnFZFEjr1zCsicMWpAA", true, false},
+		{"valid", true, signTestJWT(t, testKey(t, 0), "k1", valid), false, true},
+		{"expired", true, signTestJWT(t, testKey(t, 0), "k1", expired), false, false},
+		{"bad signature", true, signTestJWT(t, testKey(t, 1), "k1", valid), false, false},
+		{"unverified without a JWKS", false, signTestJWT(t, testKey(t, 1), "k1", valid), false, true},
+		{"expired without a JWKS", false, signTestJWT(t, testKey(t, 1), "k1", expired), false, false},
+	} {
+		p := newTestProvider()
+		if tt.jwks {
+			p.SetJWKSURL(jwks.URL)
+		}
+		claims, err := p.DecodeAccessToken(tt.token)
+		if (err == ErrOpaqueAccessToken) != tt.opaque || (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (claims["sub"] != "1" || claims["scope"] != "read") {
+			t.Errorf("%s: claims = %v", tt.name, claims)
+		}
+	}
+}
@@ -2,12 +2,20 @@ package aps
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/markbates/goth"
 	"golang.org/x/oauth2"
@@ -17,19 +25,91 @@ const (
 	authURL         string = "http://localhost:9096/authorize"
 	tokenURL        string = "http://localhost:9096/token"
 	endpointProfile string = "http://localhost:9096/userinfo"
+
+	// defaultMaxUserInfoSize caps the userinfo response body read by
+	// FetchUser unless changed with SetMaxUserInfoSize.
+	defaultMaxUserInfoSize int64 = 1 << 20
+)
+
+// DefaultScopes are the scopes requested by providers created without
+// scopes. Changing it affects providers created afterwards.
+var DefaultScopes = []string{"profile", "email", "openid"}
+
+var (
+	// ErrRedirectURLNotAllowed is returned when a redirect URL that was not
+	// registered with the provider is requested.
+	ErrRedirectURLNotAllowed = errors.New("redirect URL is not allowed")
+	// ErrUserInfoTooLarge is returned by FetchUser when the userinfo
+	// response body exceeds the configured maximum size.
+	ErrUserInfoTooLarge = errors.New("userinfo response exceeds the maximum allowed size")
+	// ErrMissingUserID is returned by FetchUser when neither the userinfo
+	// response nor the id_token identify the user.
+	ErrMissingUserID = errors.New("no user ID in userinfo response or id_token")
+	// ErrEmptyUserInfo is returned by FetchUser when the userinfo endpoint
+	// answers with an empty body.
+	ErrEmptyUserInfo = errors.New("userinfo response is empty")
+	// ErrRedirectURINotRegistered is returned when an authorization flow
+	// is started with a redirect URI missing from the list set with
+	// SetRegisteredRedirectURIs, which the server would reject.
+	ErrRedirectURINotRegistered = errors.New("redirect URI is not registered with the authorization server")
+	// ErrUserInfoRequest matches, with errors.Is, failures to get a
+	// response from the userinfo endpoint, including server errors.
+	ErrUserInfoRequest = errors.New("userinfo request failed")
+	// ErrDecodeUserInfo matches, with errors.Is, userinfo responses that
+	// cannot be decoded.
+	ErrDecodeUserInfo = errors.New("cannot decode userinfo response")
+	// ErrTokenExchange matches, with errors.Is, failures of the token
+	// request exchanging an authorization code or, with ExchangeToken, a
+	// token.
+	ErrTokenExchange = errors.New("token exchange failed")
 )
 
 // New creates a new aps provider, and sets up important connection details.
 // You should always call `gplus.New` to get a new Provider. Never try to create
 // one manually.
 func New(clientKey, secret, callbackURL string, scopes ...string) *Provider {
+	return NewCustomisedURL(clientKey, secret, callbackURL, authURL, tokenURL, endpointProfile, scopes...)
+}
+
+// NewCustomisedURL is similar to New(...) but can be used to set custom URLs
+// to connect to, e.g. a server other than the local development one.
+// The URLs are not checked here, but requests to plaintext http endpoints on
+// remote hosts fail with an *InsecureEndpointError unless
+// AllowInsecureTransport(true) is called. Invalid options, such as an empty
+// client ID, leave the provider unusable; NewValidated reports them, and
+// insecure endpoints, instead.
+func NewCustomisedURL(clientKey, secret, callbackURL, authURL, tokenURL, profileURL string, scopes ...string) *Provider {
+	p, _ := newProvider(clientKey, secret, callbackURL, authURL, tokenURL, profileURL, scopes)
+	return p
+}
+
+// NewValidated is like NewCustomisedURL but returns an error when the
+// options are invalid, e.g. the client ID, secret or callback URL is empty,
+// or an endpoint is a plaintext http URL on a remote host.
+func NewValidated(clientKey, secret, callbackURL, authURL, tokenURL, profileURL string, scopes ...string) (*Provider, error) {
+	p, err := newProvider(clientKey, secret, callbackURL, authURL, tokenURL, profileURL, scopes)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.config.checkEndpoints(authURL, tokenURL, profileURL); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newProvider creates a provider, returning it along with the error of its
+// config, if any.
+func newProvider(clientKey, secret, callbackURL, authURL, tokenURL, profileURL string, scopes []string) (*Provider, error) {
 	p := &Provider{
-		ClientKey:   clientKey,
-		Secret:      secret,
-		CallbackURL: callbackURL,
+		ClientKey:    clientKey,
+		Secret:       secret,
+		CallbackURL:  callbackURL,
+		providerName: "aps",
+		profileURL:   profileURL,
 	}
-	p.config = newConfig(p, scopes)
-	return p
+	var err error
+	p.config, err = newConfig(p, authURL, tokenURL, scopes)
+	return p, err
 }
 
 // Provider is the implementation of `goth.Provider` for accessing aps.
@@ -39,32 +119,348 @@ type Provider struct {
 	CallbackURL string
 	config      *Config
 	prompt      oauth2.AuthCodeOption
+	// loginHint, maxAge and responseMode are the login_hint, max_age and
+	// response_mode authorize parameters, nil when unset.
+	loginHint    oauth2.AuthCodeOption
+	maxAge       oauth2.AuthCodeOption
+	responseMode oauth2.AuthCodeOption
+	providerName string
+	// profileURL is the userinfo endpoint queried by FetchUser.
+	profileURL string
+	// jwksURL is the location of the server's JSON Web Key Set.
+	jwksURL string
+	// discovery is the metadata the provider was discovered from, if any.
+	discovery *DiscoveryDocument
+	// redirectURLs lists the redirect URLs, besides CallbackURL, that may
+	// be requested through BeginAuthWithRedirect.
+	redirectURLs []string
+	// registeredRedirectURIs, if set, are the only redirect URIs flows
+	// may be started with.
+	registeredRedirectURIs []string
+	// membershipsURL is the endpoint read by FetchUserMemberships.
+	membershipsURL string
+	// trailingSlash normalizes the endpoints as they are set.
+	trailingSlash TrailingSlash
+	// endSessionURL is the OIDC end_session_endpoint used by LogoutURL.
+	endSessionURL string
+	// postLogoutRedirectURLs lists the URLs LogoutURL may send users to.
+	postLogoutRedirectURLs []string
+	// maxUserInfoSize is the largest userinfo body FetchUser will read.
+	maxUserInfoSize int64
+	// userInfoAccept is the Accept header sent with the userinfo request.
+	userInfoAccept string
+	// acceptLanguage is the Accept-Language header sent with the userinfo
+	// request.
+	acceptLanguage string
+	// userInfoHeader holds extra headers for the userinfo request.
+	userInfoHeader http.Header
+	// jwks verifies signed responses when a JWKS URL is configured.
+	jwks *keySet
+	// trustedIssuer selects the issuers whose own JWKS verify tokens;
+	// their key sets are cached in issuerKeys.
+	trustedIssuer func(string) bool
+	issuerMu      sync.Mutex
+	issuerKeys    map[string]*issuerKeySet
+	// jwksTimeout and jwksMinInterval configure the JWKS requests.
+	jwksTimeout     time.Duration
+	jwksMinInterval time.Duration
+	// stateEncoder generates state values when BeginAuth is given none.
+	stateEncoder func() (string, error)
+	// scopeNormalizer maps scopes to the form they are compared in.
+	scopeNormalizer func(string) string
+	// validateScopes checks requested scopes against the discovery
+	// document's scopes_supported.
+	validateScopes bool
+	// stateSecret signs the states of EncodeState.
+	stateSecret []byte
+	// idTokenMaxAge, clockSkew and requireIssuedAt control the id_token
+	// iat and nbf checks; a nil clockSkew means defaultClockSkew.
+	idTokenMaxAge   time.Duration
+	clockSkew       *time.Duration
+	requireIssuedAt bool
+	// idTokenDecrypter decrypts encrypted id_tokens.
+	idTokenDecrypter crypto.Decrypter
+	// emptyUserInfoFromIDToken reads the user from the id_token claims
+	// when the userinfo response is empty.
+	emptyUserInfoFromIDToken bool
+	// strictDecode rejects userinfo fields the user struct doesn't know.
+	strictDecode bool
+	// nickNameClaim is the claim NickName is read from, if set.
+	nickNameClaim string
+	// userInfoFallback reads the user from the id_token claims when the
+	// userinfo endpoint is unavailable.
+	userInfoFallback bool
+	// pkce makes flows use a PKCE code_verifier.
+	pkce bool
 }
 
 // Name is the name used to retrieve this provider later.
 func (p *Provider) Name() string {
-	return "aps"
+	return p.providerName
+}
+
+// SetName is to update the name of the provider (needed in case of multiple
+// providers of 1 type, e.g. staging and production auth servers).
+func (p *Provider) SetName(name string) {
+	p.providerName = name
+}
+
+// Scopes returns a copy of the scopes the provider requests.
+func (p *Provider) Scopes() []string {
+	return append([]string(nil), p.config.scopes()...)
+}
+
+// DisableOpenID stops the provider from requesting the openid scope, for
+// OAuth 2.0 servers without OpenID Connect that reject it. It applies to
+// the default scopes as well as to ones passed to New.
+func (p *Provider) DisableOpenID(disable bool) {
+	p.config.noOpenID = disable
+}
+
+// OAuth2Config returns a copy of the provider's configuration as an
+// *oauth2.Config; see Config.OAuth2Config.
+func (p *Provider) OAuth2Config() *oauth2.Config {
+	return p.config.OAuth2Config()
+}
+
+// Close closes the idle connections of the provider's own transport, which
+// SetTLSConfig, SetClientCertificate, InsecureSkipVerify and
+// SetMaxIdleConnsPerHost give it, for a clean shutdown. DefaultTransport,
+// shared with other providers, is left alone. The provider remains usable.
+// It is safe to call more than once and concurrently.
+func (p *Provider) Close() error {
+	p.config.closeIdleConnections()
+	return nil
 }
 
 // Debug is a no-op for the gplus package.
 func (p *Provider) Debug(debug bool) {}
 
-// BeginAuth asks goth for an authentication end-point.
+// BeginAuth asks goth for an authentication end-point. The state is passed
+// through untouched; an empty state is replaced by one from GenerateState.
 func (p *Provider) BeginAuth(state string) (goth.Session, error) {
-	var opts []oauth2.AuthCodeOption
-	if p.prompt != nil {
-		opts = append(opts, p.prompt)
+	return p.beginAuth(state, p.config.opts.RedirectURL, nil)
+}
+
+// BeginAuthWithScopes works like BeginAuth but requests scopes instead of
+// the provider's scopes for this flow only, e.g. to step up to more scopes
+// with SetPrompt("consent") before a sensitive action. The session
+// remembers them so the token exchange requests the same scopes.
+func (p *Provider) BeginAuthWithScopes(state string, scopes ...string) (goth.Session, error) {
+	return p.beginAuth(state, p.config.opts.RedirectURL, scopes)
+}
+
+// BeginAuthWithOptions works like BeginAuth with opts added to the
+// authorize URL for this flow only, overriding the provider's settings,
+// e.g. Prompt("consent"). Unlike the setters, it is safe for concurrent
+// flows needing different parameters.
+func (p *Provider) BeginAuthWithOptions(state string, opts ...oauth2.AuthCodeOption) (goth.Session, error) {
+	return p.beginAuth(state, p.config.opts.RedirectURL, nil, opts...)
+}
+
+// Prompt returns an option setting the prompt of a single flow, for
+// BeginAuthWithOptions and AuthURL.
+func Prompt(prompt ...string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("prompt", strings.Join(prompt, " "))
+}
+
+// beginAuth starts a flow sending the user back to redirectURL, generating
+// a state when state is empty.
+func (p *Provider) beginAuth(state, redirectURL string, scopes []string, extra ...oauth2.AuthCodeOption) (goth.Session, error) {
+	if !p.redirectRegistered(redirectURL) {
+		return nil, ErrRedirectURINotRegistered
 	}
-	url, err := p.config.AuthCodeURL(state)
+	requested := scopes
+	if len(requested) == 0 {
+		requested = p.config.scopes()
+	}
+	if err := p.checkScopesSupported(requested); err != nil {
+		return nil, err
+	}
+	opts := p.authCodeOptions()
+	if len(scopes) > 0 {
+		opts = append(opts, scopeOption(scopes))
+	}
+	// Later options win, so the per-flow ones override the defaults.
+	opts = append(opts, extra...)
+	if state == "" {
+		var err error
+		if state, err = p.GenerateState(); err != nil {
+			return nil, err
+		}
+	}
+	var verifier string
+	if p.pkce {
+		var challenge []oauth2.AuthCodeOption
+		var err error
+		if verifier, challenge, err = pkceOptions(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, challenge...)
+	}
+	url, err := p.config.authCodeURL(state, redirectURL, opts...)
+	// Remember the redirect_uri so the token exchange sends the same one,
+	// even if CallbackURL changes in between.
 	session := &Session{
-		AuthURL: url,
+		AuthURL:      url,
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string(nil), scopes...),
+		CodeVerifier: verifier,
 	}
 	return session, err
 }
 
+// authCodeOptions returns the authorize URL options configured on the
+// provider, such as the prompt.
+func (p *Provider) authCodeOptions() []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	for _, opt := range []oauth2.AuthCodeOption{p.prompt, p.loginHint, p.maxAge, p.responseMode} {
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// scopeOption overrides the requested scopes.
+func scopeOption(scopes []string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("scope", strings.Join(scopes, " "))
+}
+
+// AuthURL returns the URL of the authorization endpoint for state, without
+// creating a Session. Opts add or override query parameters.
+func (p *Provider) AuthURL(state string, opts ...oauth2.AuthCodeOption) (string, error) {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+// BeginAuthWithRedirect works like BeginAuth but asks the provider to send
+// the user back to redirectURL instead of CallbackURL. The URL must have been
+// registered with SetRedirectURLs; the session remembers it so the token
+// exchange sends the same redirect_uri. As with BeginAuth, a state is
+// generated when state is empty.
+func (p *Provider) BeginAuthWithRedirect(state, redirectURL string) (goth.Session, error) {
+	if !p.redirectAllowed(redirectURL) {
+		return nil, ErrRedirectURLNotAllowed
+	}
+	return p.beginAuth(state, redirectURL, nil)
+}
+
+// Exchange exchanges an authorization code for a token, for applications
+// handling the callback and their sessions themselves. Opts add or override
+// parameters of the token request, such as a PKCE code_verifier. An id_token
+// in the response is verified like in Session.Authorize.
+func (p *Provider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.exchange(ctx, code, p.config.opts.RedirectURL, opts...)
+}
+
+// exchange exchanges code, obtained with redirectURL, for a token and
+// verifies its id_token, if any.
+func (p *Provider) exchange(ctx context.Context, code, redirectURL string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	token, err := p.config.exchange(ctx, code, redirectURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if idToken, _ := token.Extra("id_token").(string); idToken != "" {
+		claims, err := p.verifyIDToken(idToken)
+		if err != nil {
+			return nil, err
+		}
+		if err := claims.verifyAccessTokenHash(token.AccessToken); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// SetRedirectURLs sets the allow-list of redirect URLs accepted by
+// BeginAuthWithRedirect. CallbackURL is always allowed.
+func (p *Provider) SetRedirectURLs(urls ...string) {
+	p.redirectURLs = append([]string(nil), urls...)
+}
+
+// SetRegisteredRedirectURIs sets the redirect URIs registered for the
+// client at the authorization server. When set, starting a flow whose
+// redirect URI, CallbackURL included, is not one of them fails with
+// ErrRedirectURINotRegistered instead of the server showing the user a
+// redirect_uri mismatch error.
+func (p *Provider) SetRegisteredRedirectURIs(uris ...string) {
+	p.registeredRedirectURIs = append([]string(nil), uris...)
+}
+
+// redirectRegistered reports whether redirectURL is registered, which any
+// URL is when no list was set.
+func (p *Provider) redirectRegistered(redirectURL string) bool {
+	if len(p.registeredRedirectURIs) == 0 {
+		return true
+	}
+	for _, u := range p.registeredRedirectURIs {
+		if u == redirectURL {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) redirectAllowed(redirectURL string) bool {
+	if redirectURL == "" {
+		return false
+	}
+	if redirectURL == p.CallbackURL {
+		return true
+	}
+	for _, u := range p.redirectURLs {
+		if u == redirectURL {
+			return true
+		}
+	}
+	return false
+}
+
 // FetchUser will go to aps and access basic information about the user.
+//
+// RawData["roles"] and RawData["groups"] merge the claims of those names
+// from the userinfo response, the id_token and a JWT access token. Unless
+// a JWKS URL is set or the token's issuer is trusted, the claims of the
+// access token are read from its unverified payload.
 func (p *Provider) FetchUser(session goth.Session) (goth.User, error) {
+	user, _, err := p.FetchUserWithResponse(session)
+	return user, err
+}
+
+// FetchUserWithResponse works like FetchUser and also returns the headers of
+// the userinfo response, e.g. for auditing rate limit or caching headers.
+// The headers are nil if no response was received.
+func (p *Provider) FetchUserWithResponse(session goth.Session) (goth.User, http.Header, error) {
+	return p.fetchUser(context.Background(), session)
+}
+
+// FetchUserContext works like FetchUser, but the userinfo request is
+// cancelled when ctx is done and traced as a child of its span.
+func (p *Provider) FetchUserContext(ctx context.Context, session goth.Session) (goth.User, error) {
+	user, _, err := p.fetchUser(ctx, session)
+	return user, err
+}
+
+// FetchUserByToken fetches the user authorized by accessToken, e.g. one
+// received from another service, without a session from this provider.
+// The user has no refresh token or expiry, and no id_token is available to
+// complete the userinfo response.
+func (p *Provider) FetchUserByToken(ctx context.Context, accessToken string) (goth.User, error) {
+	user, _, err := p.fetchUser(ctx, &Session{AccessToken: accessToken})
+	return user, err
+}
+
+// fetchUser requests the userinfo of session, giving up when ctx is done.
+func (p *Provider) fetchUser(ctx context.Context, session goth.Session) (goth.User, http.Header, error) {
+	ctx, span := p.config.startSpan(ctx, "aps.userinfo", p.profileURL)
+	user, header, err := p.requestUser(ctx, session)
+	endSpan(span, err)
+	return user, header, err
+}
+
+func (p *Provider) requestUser(ctx context.Context, session goth.Session) (goth.User, http.Header, error) {
 	sess := session.(*Session)
+	var header http.Header
 	user := goth.User{
 		AccessToken:  sess.AccessToken,
 		Provider:     p.Name(),
@@ -72,41 +468,275 @@ func (p *Provider) FetchUser(session goth.Session) (goth.User, error) {
 		ExpiresAt:    sess.ExpiresAt,
 	}
 
-	response, err := http.Get(endpointProfile + "?access_token=" + url.QueryEscape(sess.AccessToken))
+	// A rejected token is sometimes answered with a redirect to a login
+	// page; don't follow it and end up decoding HTML.
+	client := *p.config.httpClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, err := p.newUserInfoRequest(ctx, sess.AccessToken)
+	if err != nil {
+		return user, header, redactURLError(err, sess.AccessToken)
+	}
+	if err := p.config.breaker.allow(); err != nil {
+		return p.fallbackUser(sess, user, header, err)
+	}
+	response, err := client.Do(req)
 	if err != nil {
-		if response != nil {
-			response.Body.Close()
+		p.config.breaker.done(ctx, 0, err)
+		err = redactURLError(err, sess.AccessToken)
+		return p.fallbackUser(sess, user, header, wrapError(ErrUserInfoRequest, err))
+	}
+	p.config.breaker.done(ctx, response.StatusCode, nil)
+	defer drainAndClose(response.Body)
+	header = response.Header
+	spanFromContext(ctx).SetAttribute(attrStatusCode, response.StatusCode)
+
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		return p.fallbackUser(sess, user, header, fmt.Errorf("%w: %s", ErrUserInfoRequest, response.Status))
+	}
+
+	if response.StatusCode >= 300 && response.StatusCode < 400 {
+		return user, header, &UserInfoRedirectError{
+			StatusCode: response.StatusCode,
+			Location:   response.Header.Get("Location"),
 		}
-		return user, err
 	}
-	defer response.Body.Close()
 
-	bits, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return user, header, newUserInfoAuthError(response)
+	}
+
+	limit := p.maxUserInfoSize
+	if limit <= 0 {
+		limit = defaultMaxUserInfoSize
+	}
+
+	// Decode the body once into a raw message and build both RawData and
+	// the typed fields from it, instead of buffering the whole body first.
+	// The limit counts the bytes read until EOF, so it holds for chunked
+	// responses without a Content-Length too. A gzip body that the
+	// transport left compressed, because an Accept-Encoding header was set
+	// explicitly, is limited after decompression.
+	var raw json.RawMessage
+	var decoded io.Reader = response.Body
+	if strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return user, header, wrapError(ErrDecodeUserInfo, err)
+		}
+		defer gz.Close()
+		decoded = gz
+	}
+	body := &maxBytesReader{r: decoded, n: limit}
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType == "application/jwt" {
+		raw, err = p.userInfoFromJWT(body)
+	} else {
+		err = json.NewDecoder(body).Decode(&raw)
+		if err == io.EOF {
+			err = ErrEmptyUserInfo
+		} else if err != nil && err != ErrUserInfoTooLarge {
+			err = wrapError(ErrDecodeUserInfo, err)
+		}
+	}
+	if err == ErrEmptyUserInfo && p.emptyUserInfoFromIDToken && sess.IDToken != "" {
+		_, raw, err = p.verifyIDTokenPayload(sess.IDToken)
+	}
 	if err != nil {
-		return user, err
+		return user, header, err
+	}
+	err = p.userFromRaw(sess, &user, raw, p.strictDecode)
+	return user, header, err
+}
+
+// fallbackUser handles the failure err of a userinfo request: when
+// AllowUserInfoFallback is set and the session has a valid id_token, the
+// user is read from its claims and returned with a *UserInfoFallbackError,
+// otherwise err is returned as is.
+func (p *Provider) fallbackUser(sess *Session, user goth.User, header http.Header, err error) (goth.User, http.Header, error) {
+	if !p.userInfoFallback || sess.IDToken == "" {
+		return user, header, err
+	}
+	_, raw, verr := p.verifyIDTokenPayload(sess.IDToken)
+	if verr != nil {
+		return user, header, err
 	}
+	// The id_token has claims the user struct doesn't know, so it is never
+	// decoded strictly.
+	if uerr := p.userFromRaw(sess, &user, raw, false); uerr != nil {
+		return user, header, err
+	}
+	return user, header, &UserInfoFallbackError{Err: err}
+}
 
-	err = json.NewDecoder(bytes.NewReader(bits)).Decode(&user.RawData)
+// userFromRaw fills user from the userinfo claims raw of sess.
+func (p *Provider) userFromRaw(sess *Session, user *goth.User, raw json.RawMessage, strict bool) error {
+	err := json.Unmarshal(raw, &user.RawData)
 	if err != nil {
-		return user, err
+		return wrapError(ErrDecodeUserInfo, err)
 	}
+	if sess.GrantedScopes != nil {
+		if user.RawData == nil {
+			user.RawData = map[string]interface{}{}
+		}
+		user.RawData["scopes"] = sess.GrantedScopes
+	}
+	// goth.User has no id_token field; keep the raw token for callers that
+	// forward it, e.g. to a token exchange.
+	if sess.IDToken != "" {
+		if user.RawData == nil {
+			user.RawData = map[string]interface{}{}
+		}
+		user.RawData["id_token"] = sess.IDToken
+	}
+	p.setRoleClaims(sess, user, raw)
 
-	err = userFromReader(bytes.NewReader(bits), &user)
-	return user, err
+	err = userFromReader(bytes.NewReader(raw), user, strict)
+	if err != nil {
+		return wrapError(ErrDecodeUserInfo, err)
+	}
+	if nick, _ := user.RawData[p.nickNameClaim].(string); p.nickNameClaim != "" && nick != "" {
+		user.NickName = nick
+	}
+
+	// Some servers only carry the subject in the id_token.
+	if user.UserID == "" && sess.IDToken != "" {
+		claims, _, err := p.verifyIDTokenPayload(sess.IDToken)
+		if err != nil {
+			return err
+		}
+		user.UserID = claims.Subject
+	}
+	if user.UserID == "" {
+		return ErrMissingUserID
+	}
+	return nil
+}
+
+// newUserInfoRequest prepares the userinfo request for accessToken. The
+// token goes in the query, where the server reads it; errors carrying the
+// request URL must go through redactURLError.
+func (p *Provider) newUserInfoRequest(ctx context.Context, accessToken string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.profileURL+"?access_token="+url.QueryEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range p.userInfoHeader {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	if p.userInfoAccept != "" {
+		req.Header.Set("Accept", p.userInfoAccept)
+	}
+	if p.acceptLanguage != "" {
+		req.Header.Set("Accept-Language", p.acceptLanguage)
+	}
+	return req, nil
+}
+
+// userInfoFromJWT reads a signed userinfo response and returns its claims,
+// verifying the signature when a JWKS URL is configured.
+func (p *Provider) userInfoFromJWT(body io.Reader) (json.RawMessage, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, ErrEmptyUserInfo
+	}
+	t, err := p.verifyJWT(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	return t.Payload, nil
+}
+
+// UserInfoRedirectError is returned by FetchUser when the userinfo endpoint
+// answers with a redirect instead of the user's profile, which usually means
+// the access token was rejected.
+type UserInfoRedirectError struct {
+	StatusCode int
+	Location   string
+}
+
+func (e *UserInfoRedirectError) Error() string {
+	return fmt.Sprintf("userinfo request was redirected (%d) to %q", e.StatusCode, e.Location)
+}
+
+// UserInfoFallbackError is returned by FetchUser, along with a user read
+// from the id_token claims, when AllowUserInfoFallback is set and the
+// userinfo endpoint could not be reached or failed with a server error.
+// The user is usable but only has the claims of the id_token.
+type UserInfoFallbackError struct {
+	// Err is the error of the userinfo request.
+	Err error
+}
+
+func (e *UserInfoFallbackError) Error() string {
+	return "userinfo unavailable, user read from the id_token: " + e.Err.Error()
+}
+
+func (e *UserInfoFallbackError) Unwrap() error {
+	return e.Err
+}
+
+// IsUserInfoFallback reports whether err only warns that the user returned
+// with it was read from the id_token because userinfo was unavailable.
+func IsUserInfoFallback(err error) bool {
+	var fallbackErr *UserInfoFallbackError
+	return errors.As(err, &fallbackErr)
+}
+
+// drainAndClose reads what is left of body, up to a limit, before closing
+// it so the underlying connection can be reused even when decoding stopped
+// early or failed.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+// maxBytesReader reads from r until more than n bytes have been consumed,
+// after which it fails with ErrUserInfoTooLarge.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
 }
 
-func userFromReader(reader io.Reader, user *goth.User) error {
+func (m *maxBytesReader) Read(b []byte) (int, error) {
+	if m.n < 0 {
+		return 0, ErrUserInfoTooLarge
+	}
+	if int64(len(b)) > m.n+1 {
+		b = b[:m.n+1]
+	}
+	n, err := m.r.Read(b)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, ErrUserInfoTooLarge
+	}
+	return n, err
+}
+
+func userFromReader(reader io.Reader, user *goth.User, strict bool) error {
 	u := struct {
-		ID        string `json:"id"`
-		Email     string `json:"email"`
-		Name      string `json:"name"`
-		FirstName string `json:"given_name"`
-		LastName  string `json:"family_name"`
-		Link      string `json:"link"`
-		Picture   string `json:"picture"`
+		ID        stringOrNumber  `json:"id"`
+		Subject   stringOrNumber  `json:"sub"`
+		Email     string          `json:"email"`
+		Name      string          `json:"name"`
+		Username  string          `json:"preferred_username"`
+		NickName  string          `json:"nickname"`
+		Login     string          `json:"login"`
+		FirstName string          `json:"given_name"`
+		LastName  string          `json:"family_name"`
+		Link      string          `json:"link"`
+		Picture   json.RawMessage `json:"picture"`
+		Emails    json.RawMessage `json:"emails"`
 	}{}
 
-	err := json.NewDecoder(reader).Decode(&u)
+	dec := json.NewDecoder(reader)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(&u)
 	if err != nil {
 		return err
 	}
@@ -114,18 +744,118 @@ func userFromReader(reader io.Reader, user *goth.User) error {
 	user.Name = u.Name
 	user.FirstName = u.FirstName
 	user.LastName = u.LastName
-	user.NickName = u.Name
+	// Prefer a handle to the full name.
+	for _, nick := range []string{u.Username, u.NickName, u.Login, u.Name} {
+		if nick != "" {
+			user.NickName = nick
+			break
+		}
+	}
 	user.Email = u.Email
+	if user.Email == "" {
+		user.Email = primaryEmail(u.Emails)
+	}
 	//user.Description = u.Bio
-	user.AvatarURL = u.Picture
-	user.UserID = u.ID
+	user.AvatarURL = pictureURL(u.Picture)
+	user.UserID = string(u.ID)
+	if user.UserID == "" {
+		user.UserID = string(u.Subject)
+	}
 	//user.Location = u.Location.Name
 
 	return err
 }
 
+// stringOrNumber is a JSON string, or a JSON number kept as its literal,
+// for IDs some servers send as numbers.
+type stringOrNumber string
+
+func (s *stringOrNumber) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*s = stringOrNumber(v)
+	case json.Number:
+		*s = stringOrNumber(v.String())
+	case nil:
+		*s = ""
+	default:
+		return fmt.Errorf("expected a string or a number, got %s", b)
+	}
+	return nil
+}
+
+// primaryEmail picks the address to use from an emails claim, which is
+// either a list of addresses or a list of objects with primary and verified
+// flags (GitHub style). A primary, verified address is preferred, then a
+// primary one, then a verified one, then the first.
+func primaryEmail(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		if len(list) > 0 {
+			return list[0]
+		}
+		return ""
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.Unmarshal(raw, &emails); err != nil || len(emails) == 0 {
+		return ""
+	}
+	best, bestRank := emails[0].Email, -1
+	for _, e := range emails {
+		rank := 0
+		if e.Primary {
+			rank += 2
+		}
+		if e.Verified {
+			rank++
+		}
+		if rank > bestRank {
+			best, bestRank = e.Email, rank
+		}
+	}
+	return best
+}
+
+// pictureURL extracts the avatar URL from a picture claim, which is either
+// a plain string or an object such as {"data": {"url": "..."}}.
+func pictureURL(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var obj struct {
+		URL  string `json:"url"`
+		Data struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return ""
+	}
+	if obj.Data.URL != "" {
+		return obj.Data.URL
+	}
+	return obj.URL
+}
+
 //New config for provider
-func newConfig(provider *Provider, scopes []string) *Config {
+func newConfig(provider *Provider, authURL, tokenURL string, scopes []string) (*Config, error) {
 	c, err := NewConfig(&Options{
 		ClientID:     provider.ClientKey,
 		ClientSecret: provider.Secret,
@@ -139,31 +869,223 @@ func newConfig(provider *Provider, scopes []string) *Config {
 				c.opts.Scopes = append(c.opts.Scopes, scope)
 			}
 		} else {
-			c.opts.Scopes = []string{"profile", "email", "openid"}
+			c.opts.Scopes = append([]string(nil), DefaultScopes...)
 		}
 	}
-	return c
+	return c, err
 }
 
 //RefreshTokenAvailable refresh token is provided by auth provider or not
+//
+// It is false when online access was requested, or when the server's
+// discovery metadata doesn't list the refresh_token grant. Whether a given
+// session actually holds a refresh token is told by Session.HasRefreshToken.
 func (p *Provider) RefreshTokenAvailable() bool {
+	if p.config.opts.AccessType == "online" {
+		return false
+	}
+	if p.discovery != nil && len(p.discovery.GrantTypesSupported) > 0 {
+		for _, grant := range p.discovery.GrantTypesSupported {
+			if grant == "refresh_token" {
+				return true
+			}
+		}
+		return false
+	}
 	return true
 }
 
 //RefreshToken get new access token based on the refresh token
+//
+// Servers that rotate refresh tokens invalidate refreshToken once it has been
+// used; the returned token then carries the new refresh token, which callers
+// must persist in place of the old one (see OnTokenRefreshed). When the server
+// does not rotate, the returned token keeps refreshToken.
 func (p *Provider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
-	//token := &oauth2.Token{RefreshToken: refreshToken}
-	newToken := p.config.NewTransport().Token()
-	return newToken, nil
+	return p.RefreshTokenWithContext(context.Background(), refreshToken)
+}
+
+// RefreshTokenWithContext works like RefreshToken, but the request is
+// cancelled when ctx is done and traced as a child of its span.
+func (p *Provider) RefreshTokenWithContext(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	return p.config.FetchTokenContext(ctx, &oauth2.Token{RefreshToken: refreshToken})
+}
+
+// OnTokenRefreshed registers fn to be called with every token obtained
+// through a refresh, whether via RefreshToken or a transport created from the
+// provider's config. Persistence layers use it to save rotated refresh tokens.
+func (p *Provider) OnTokenRefreshed(fn func(*oauth2.Token)) {
+	p.config.onTokenRefreshed = fn
+}
+
+// SetTokenRequestHook sets a function called with every request to the
+// token endpoint, for code exchanges, refreshes and token exchanges, just
+// before it is sent, e.g. to add a header or sign the request with a fresh
+// nonce. It runs again for a retried request. An error aborts the request
+// and is returned to the caller. Nil removes the hook.
+func (p *Provider) SetTokenRequestHook(hook func(*http.Request) error) {
+	p.config.tokenRequestHook = hook
+}
+
+// SetUserInfoAccept sets the Accept header sent with the userinfo request.
+// Use "application/jwt" to ask servers that support it for a signed
+// response; FetchUser decodes JWT and JSON responses alike.
+func (p *Provider) SetUserInfoAccept(accept string) {
+	p.userInfoAccept = accept
+}
+
+// SetAcceptLanguage sets the Accept-Language header sent with the userinfo
+// request, e.g. "fr-CH, fr;q=0.9", for servers that localize the profile
+// they return. No header is sent by default.
+func (p *Provider) SetAcceptLanguage(lang string) {
+	p.acceptLanguage = lang
+}
+
+// SetUserInfoHeader adds a header sent with every userinfo request, such as
+// an API gateway key. The Authorization header cannot be set this way.
+func (p *Provider) SetUserInfoHeader(key, value string) error {
+	if http.CanonicalHeaderKey(key) == "Authorization" {
+		return errors.New("the Authorization header cannot be overridden")
+	}
+	if p.userInfoHeader == nil {
+		p.userInfoHeader = http.Header{}
+	}
+	p.userInfoHeader.Set(key, value)
+	return nil
+}
+
+// SetMaxUserInfoSize sets the maximum number of bytes FetchUser reads from
+// the userinfo response. Zero or a negative value restores the 1MB default.
+func (p *Provider) SetMaxUserInfoSize(n int64) {
+	p.maxUserInfoSize = n
+}
+
+// EmptyUserInfoFromIDToken makes FetchUser build the user from the claims
+// of the session's id_token when the userinfo endpoint answers with an empty
+// body, instead of failing with ErrEmptyUserInfo.
+func (p *Provider) EmptyUserInfoFromIDToken(enable bool) {
+	p.emptyUserInfoFromIDToken = enable
+}
+
+// SetNickNameClaim sets the claim the user's NickName is read from, for
+// servers with a custom username claim. When it is unset or missing from
+// the response, NickName is the first of preferred_username, nickname and
+// login present, or else the name.
+func (p *Provider) SetNickNameClaim(claim string) {
+	p.nickNameClaim = claim
+}
+
+// AllowUserInfoFallback makes FetchUser read the user from the id_token
+// claims when the userinfo endpoint can't be reached or answers with a
+// server error or 429, so a login isn't failed by a userinfo outage. The
+// user is then returned with a *UserInfoFallbackError, which callers accept
+// with IsUserInfoFallback. Sessions without an id_token still fail.
+func (p *Provider) AllowUserInfoFallback(allow bool) {
+	p.userInfoFallback = allow
+}
+
+// StrictDecode makes FetchUser fail when the userinfo response has a field
+// it doesn't map to the user, to catch changes of the server's schema.
+// RawData still receives every field. Decoding is lenient by default.
+func (p *Provider) StrictDecode(strict bool) {
+	p.strictDecode = strict
+}
+
+// SetRateLimitRetry makes token requests answered with 429 Too Many Requests
+// wait for the server's Retry-After delay and retry once, as long as the delay
+// is at most maxWait. By default, and when the delay is longer, the request
+// fails with an *ErrRateLimited so the caller can decide.
+func (p *Provider) SetRateLimitRetry(maxWait time.Duration) {
+	p.config.rateLimitMaxWait = maxWait
+}
+
+// SetSecret rotates the client secret without rebuilding the provider. It
+// is safe to call while requests are in flight; token requests made after
+// it returns use newSecret.
+func (p *Provider) SetSecret(newSecret string) {
+	p.config.secretMu.Lock()
+	defer p.config.secretMu.Unlock()
+	p.Secret = newSecret
+	p.config.opts.ClientSecret = newSecret
+}
+
+// SetResource sets the resource indicators (RFC 8707) identifying the APIs
+// the tokens are meant for. Each one is sent as a resource parameter of
+// both the authorize and token requests.
+func (p *Provider) SetResource(resources ...string) {
+	p.config.resources = append([]string(nil), resources...)
+}
+
+// SetRefreshParam adds a non-standard form parameter, such as a tenant, to
+// the refresh token requests. Parameters defined by OAuth 2.0 for the
+// refresh request and client authentication can't be overridden and are
+// ignored.
+func (p *Provider) SetRefreshParam(key, value string) {
+	switch key {
+	case "grant_type", "refresh_token", "client_id", "client_secret",
+		"client_assertion", "client_assertion_type", "resource":
+		return
+	}
+	if p.config.refreshParams == nil {
+		p.config.refreshParams = url.Values{}
+	}
+	p.config.refreshParams.Set(key, value)
+}
+
+// SetAccessType sets the access_type sent to the authorize endpoint.
+// Google-style servers issue a refresh token only for "offline" access, and
+// only on the first consent unless it is paired with SetPrompt("consent"):
+//
+//	p.SetAccessType("offline")
+//	p.SetPrompt("consent")
+//
+// With "online" access RefreshTokenAvailable reports false.
+func (p *Provider) SetAccessType(accessType string) {
+	p.config.opts.AccessType = accessType
 }
 
 // SetPrompt sets the prompt values for the GPlus OAuth call. Use this to
 // force users to choose and account every time by passing "select_account",
 // for example.
 // See https://developers.google.com/identity/protocols/OpenIDConnect#authenticationuriparameters
+//
+// Deprecated: SetPrompt changes the default of every flow and must not be
+// called while flows are started. Pass Prompt to BeginAuthWithOptions to set
+// the prompt of a single flow; SetPrompt still works as the default.
 func (p *Provider) SetPrompt(prompt ...string) {
 	if len(prompt) == 0 {
 		return
 	}
-	p.prompt = oauth2.SetAuthURLParam("prompt", strings.Join(prompt, " "))
+	p.prompt = Prompt(prompt...)
+}
+
+// SetResponseMode sets the response_mode sent to the authorize endpoint,
+// e.g. "form_post" to have the code and state POSTed to the callback
+// instead of sent in its query, which CompleteUserAuth handles. An empty
+// mode removes it, leaving the server's default.
+func (p *Provider) SetResponseMode(mode string) {
+	p.responseMode = nil
+	if mode != "" {
+		p.responseMode = oauth2.SetAuthURLParam("response_mode", mode)
+	}
+}
+
+// SetLoginHint sets the login_hint sent to the authorize endpoint, usually
+// the user's email address, to pre-fill the login form. An empty hint
+// removes it.
+func (p *Provider) SetLoginHint(hint string) {
+	p.loginHint = nil
+	if hint != "" {
+		p.loginHint = oauth2.SetAuthURLParam("login_hint", hint)
+	}
+}
+
+// SetMaxAge sets the max_age sent to the authorize endpoint: the user has
+// to reauthenticate if they logged in more than seconds ago, so zero forces
+// reauthentication. A negative value removes it.
+func (p *Provider) SetMaxAge(seconds int) {
+	p.maxAge = nil
+	if seconds >= 0 {
+		p.maxAge = oauth2.SetAuthURLParam("max_age", strconv.Itoa(seconds))
+	}
 }
@@ -0,0 +1,652 @@
+package aps_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+const secretAccessToken = "very-secret-access-token-0123456789"
+
+func TestFetchUserByToken(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	user, err := p.FetchUserByToken(context.Background(), apstest.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "000000" || user.Email != "test@test.com" {
+		t.Errorf("user = %+v", user)
+	}
+}
+
+func TestUserInfoErrorsHideToken(t *testing.T) {
+	srv := apstest.NewTestServer()
+	profileURL := srv.ProfileURL()
+	srv.Close()
+
+	for name, profileURL := range map[string]string{
+		"unreachable": profileURL,
+		"invalid URL": "http://localhost/\x7f",
+	} {
+		p := aps.NewCustomisedURL(apstest.ClientID, apstest.ClientSecret, "http://localhost/callback",
+			srv.AuthURL(), srv.TokenURL(), profileURL)
+		_, err := p.FetchUserByToken(context.Background(), secretAccessToken)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+			continue
+		}
+		if strings.Contains(err.Error(), secretAccessToken) {
+			t.Errorf("%s: error contains the access token: %v", name, err)
+		}
+		if name == "unreachable" && !errors.Is(err, aps.ErrUserInfoRequest) {
+			t.Errorf("%s: error %v is not ErrUserInfoRequest", name, err)
+		}
+	}
+}
+
+func TestBeginAuthWithRedirect(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	if _, err := p.BeginAuthWithRedirect("", "http://localhost/other"); err != aps.ErrRedirectURLNotAllowed {
+		t.Errorf("unlisted redirect: err = %v, want ErrRedirectURLNotAllowed", err)
+	}
+	p.SetRedirectURLs("http://localhost/other")
+	var states []string
+	for i := 0; i < 2; i++ {
+		session, err := p.BeginAuthWithRedirect("", "http://localhost/other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess := session.(*aps.Session)
+		u, err := url.Parse(sess.AuthURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if got := q.Get("redirect_uri"); got != "http://localhost/other" || sess.RedirectURL != got {
+			t.Errorf("redirect_uri = %q, session redirect URL = %q", got, sess.RedirectURL)
+		}
+		if q.Get("state") == "" {
+			t.Fatal("no state was generated")
+		}
+		states = append(states, q.Get("state"))
+	}
+	if states[0] == states[1] {
+		t.Errorf("generated states are equal: %q", states[0])
+	}
+}
+
+func TestRedirectURLOverride(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetRedirectURLs("http://localhost/admin/callback")
+	if _, err := p.BeginAuthWithRedirect("state", "http://evil.example.com/callback"); err != aps.ErrRedirectURLNotAllowed {
+		t.Errorf("unlisted redirect: err = %v, want ErrRedirectURLNotAllowed", err)
+	}
+	// CallbackURL is always allowed.
+	if _, err := p.BeginAuthWithRedirect("state", "http://localhost/callback"); err != nil {
+		t.Errorf("CallbackURL: %v", err)
+	}
+
+	session, err := p.BeginAuthWithRedirect("state", "http://localhost/admin/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	reqs := srv.Requests()
+	if got := reqs[len(reqs)-1].Form.Get("redirect_uri"); got != "http://localhost/admin/callback" {
+		t.Errorf("exchange redirect_uri = %q, want the one the flow started with", got)
+	}
+}
+
+func TestRegisteredRedirectURIs(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetRedirectURLs("http://localhost/admin/callback")
+	p.SetRegisteredRedirectURIs("http://localhost/admin/callback")
+	if _, err := p.BeginAuth("state"); err != aps.ErrRedirectURINotRegistered {
+		t.Errorf("BeginAuth: err = %v, want ErrRedirectURINotRegistered", err)
+	}
+	if _, err := p.BeginAuthWithRedirect("state", "http://localhost/admin/callback"); err != nil {
+		t.Errorf("BeginAuthWithRedirect: %v", err)
+	}
+}
+
+func TestUserInfoPicture(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		picture interface{}
+		want    string
+	}{
+		{"string", "https://img.example.com/a.png", "https://img.example.com/a.png"},
+		{"object", map[string]interface{}{"url": "https://img.example.com/b.png"}, "https://img.example.com/b.png"},
+		{"nested data", map[string]interface{}{"data": map[string]interface{}{"url": "https://img.example.com/c.png", "width": 50}}, "https://img.example.com/c.png"},
+		{"unknown shape", []string{"https://img.example.com/d.png"}, ""},
+		{"null", nil, ""},
+	} {
+		srv := apstest.NewTestServer()
+		srv.User["picture"] = tt.picture
+		p := srv.Provider("http://localhost/callback")
+		user, err := p.FetchUserByToken(context.Background(), apstest.AccessToken)
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if user.AvatarURL != tt.want {
+			t.Errorf("%s: AvatarURL = %q, want %q", tt.name, user.AvatarURL, tt.want)
+		}
+	}
+}
+
+// unsignedJWT returns an unsigned JWT carrying claims, which providers
+// without a JWKS URL accept.
+func unsignedJWT(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func TestUserIDFromIDToken(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	delete(srv.User, "id")
+
+	p := srv.Provider("http://localhost/callback")
+	idToken := unsignedJWT(map[string]interface{}{"sub": "subject-1", "aud": apstest.ClientID})
+	user, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken, IDToken: idToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "subject-1" {
+		t.Errorf("UserID = %q, want the id_token subject", user.UserID)
+	}
+
+	if _, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken}); err != aps.ErrMissingUserID {
+		t.Errorf("without id_token: err = %v, want ErrMissingUserID", err)
+	}
+}
+
+func TestUserIDPrefersUserInfo(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	idToken := unsignedJWT(map[string]interface{}{"sub": "subject-1", "aud": apstest.ClientID})
+	user, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken, IDToken: idToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "000000" {
+		t.Errorf("UserID = %q, want the userinfo id", user.UserID)
+	}
+}
+
+func TestUserInfoRedirectNotFollowed(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	loop := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/userinfo", http.StatusFound)
+	})
+	defer loop.Close()
+
+	p := aps.NewCustomisedURL(apstest.ClientID, apstest.ClientSecret, "http://localhost/callback",
+		srv.AuthURL(), srv.TokenURL(), loop.URL+"/userinfo")
+	_, err := p.FetchUserByToken(context.Background(), apstest.AccessToken)
+	var redirectErr *aps.UserInfoRedirectError
+	if !errors.As(err, &redirectErr) {
+		t.Fatalf("err = %v, want a *UserInfoRedirectError", err)
+	}
+	if redirectErr.StatusCode != http.StatusFound || redirectErr.Location != "/userinfo" {
+		t.Errorf("redirect error = %+v", redirectErr)
+	}
+	if got := len(loop.headers()); got != 1 {
+		t.Errorf("userinfo endpoint hit %d times, want 1", got)
+	}
+}
+
+func TestStrictDecode(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	srv.User["favourite_colour"] = "blue"
+
+	p := srv.Provider("http://localhost/callback")
+	if _, err := p.FetchUserByToken(context.Background(), apstest.AccessToken); err != nil {
+		t.Fatalf("lenient decode: %v", err)
+	}
+	p.StrictDecode(true)
+	if _, err := p.FetchUserByToken(context.Background(), apstest.AccessToken); !errors.Is(err, aps.ErrDecodeUserInfo) {
+		t.Errorf("strict decode: err = %v, want ErrDecodeUserInfo", err)
+	}
+}
+
+// newConnCountingServer starts a userinfo server and returns it with the
+// number of connections it has accepted.
+func newConnCountingServer() (*httptest.Server, *int32) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"1"}`)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, &conns
+}
+
+func TestCloseLeavesOtherProviders(t *testing.T) {
+	srv, conns := newConnCountingServer()
+	defer srv.Close()
+	newProvider := func() *aps.Provider {
+		return aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/userinfo")
+	}
+	fetch := func(p *aps.Provider, wantConns int32) {
+		t.Helper()
+		if _, err := p.FetchUser(&aps.Session{AccessToken: "at", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(conns); n != wantConns {
+			t.Fatalf("%d connections, want %d", n, wantConns)
+		}
+	}
+
+	shared, closed := newProvider(), newProvider()
+	fetch(shared, 1)
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fetch(shared, 1)
+
+	own := newProvider()
+	own.SetMaxIdleConnsPerHost(2)
+	fetch(own, 2)
+	fetch(own, 2)
+	own.Close()
+	own.Close()
+	fetch(own, 3)
+	fetch(shared, 3)
+}
+
+func TestUserInfoEmail(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		email  interface{}
+		emails interface{}
+		want   string
+	}{
+		{"email", "a@example.com", nil, "a@example.com"},
+		{"email over emails", "a@example.com", []string{"b@example.com"}, "a@example.com"},
+		{"list of addresses", nil, []string{"b@example.com", "c@example.com"}, "b@example.com"},
+		{"primary and verified", nil, []map[string]interface{}{
+			{"email": "b@example.com", "verified": true},
+			{"email": "c@example.com", "primary": true},
+			{"email": "d@example.com", "primary": true, "verified": true},
+		}, "d@example.com"},
+		{"primary", nil, []map[string]interface{}{
+			{"email": "b@example.com", "verified": true},
+			{"email": "c@example.com", "primary": true},
+		}, "c@example.com"},
+		{"verified", nil, []map[string]interface{}{
+			{"email": "b@example.com"},
+			{"email": "c@example.com", "verified": true},
+		}, "c@example.com"},
+		{"neither primary nor verified", nil, []map[string]interface{}{
+			{"email": "b@example.com"},
+			{"email": "c@example.com"},
+		}, "b@example.com"},
+		{"empty list", nil, []string{}, ""},
+		{"no email", nil, nil, ""},
+	} {
+		srv := apstest.NewTestServer()
+		delete(srv.User, "email")
+		if tt.email != nil {
+			srv.User["email"] = tt.email
+		}
+		if tt.emails != nil {
+			srv.User["emails"] = tt.emails
+		}
+		p := srv.Provider("http://localhost/callback")
+		user, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken})
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if user.Email != tt.want {
+			t.Errorf("%s: Email = %q, want %q", tt.name, user.Email, tt.want)
+		}
+	}
+}
+
+func TestUserInfoID(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		id   interface{}
+		sub  interface{}
+		want string
+	}{
+		{"string id", "abc-123", nil, "abc-123"},
+		{"numeric id", 42, nil, "42"},
+		{"large numeric id", json.Number("12345678901234567890"), nil, "12345678901234567890"},
+		{"id beyond float precision", json.Number("9007199254740993"), nil, "9007199254740993"},
+		{"numeric sub", nil, json.Number("1234567890123"), "1234567890123"},
+		{"string sub", nil, "user-1", "user-1"},
+	} {
+		srv := apstest.NewTestServer()
+		srv.User["id"] = tt.id
+		if tt.sub != nil {
+			srv.User["sub"] = tt.sub
+		}
+		p := srv.Provider("http://localhost/callback")
+		user, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken})
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if user.UserID != tt.want {
+			t.Errorf("%s: UserID = %q, want %q", tt.name, user.UserID, tt.want)
+		}
+	}
+}
+
+// lastUserInfoRequest returns the last userinfo request srv received.
+func lastUserInfoRequest(t *testing.T, srv *apstest.Server) *http.Request {
+	var last *http.Request
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/userinfo" {
+			last = req
+		}
+	}
+	if last == nil {
+		t.Fatal("no userinfo request was received")
+	}
+	return last
+}
+
+func TestUserInfoHeader(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	if err := p.SetUserInfoHeader("X-Api-Key", "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUserInfoHeader("authorization", "Bearer other"); err == nil {
+		t.Error("the Authorization header was accepted")
+	}
+	if _, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken}); err != nil {
+		t.Fatal(err)
+	}
+	req := lastUserInfoRequest(t, srv)
+	if got := req.Header.Get("X-Api-Key"); got != "key-1" {
+		t.Errorf("X-Api-Key = %q, want key-1", got)
+	}
+	if got := req.Header.Get("Authorization"); got == "Bearer other" {
+		t.Errorf("Authorization = %q was overridden", got)
+	}
+}
+
+func TestAcceptLanguage(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	if _, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUserInfoRequest(t, srv).Header.Get("Accept-Language"); got != "" {
+		t.Errorf("Accept-Language = %q, want none by default", got)
+	}
+	p.SetAcceptLanguage("fr-CH, fr;q=0.9")
+	if _, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUserInfoRequest(t, srv).Header.Get("Accept-Language"); got != "fr-CH, fr;q=0.9" {
+		t.Errorf("Accept-Language = %q", got)
+	}
+}
+
+// authQuery returns the query of the authorize URL of a flow begun by p.
+func authQuery(t *testing.T, p *aps.Provider) url.Values {
+	session, err := p.BeginAuth("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(session.(*aps.Session).AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestLoginHintAndMaxAge(t *testing.T) {
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo")
+	q := authQuery(t, p)
+	if _, ok := q["login_hint"]; ok {
+		t.Errorf("login_hint sent by default: %v", q)
+	}
+	if _, ok := q["max_age"]; ok {
+		t.Errorf("max_age sent by default: %v", q)
+	}
+
+	p.SetLoginHint("user@example.com")
+	p.SetMaxAge(0)
+	q = authQuery(t, p)
+	if q.Get("login_hint") != "user@example.com" || q.Get("max_age") != "0" {
+		t.Errorf("query = %v, want the login_hint and max_age=0", q)
+	}
+
+	p.SetLoginHint("")
+	p.SetMaxAge(-1)
+	q = authQuery(t, p)
+	if _, ok := q["login_hint"]; ok {
+		t.Errorf("login_hint not removed: %v", q)
+	}
+	if _, ok := q["max_age"]; ok {
+		t.Errorf("max_age not removed: %v", q)
+	}
+}
+
+func TestDisableOpenID(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	if scope := authQuery(t, p).Get("scope"); !strings.Contains(scope, "openid") {
+		t.Errorf("scope = %q, want openid by default", scope)
+	}
+	p.DisableOpenID(true)
+	if scope := authQuery(t, p).Get("scope"); scope != "profile email" {
+		t.Errorf("scope = %q, want the default scopes without openid", scope)
+	}
+	if _, err := (&aps.Session{}).Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" && strings.Contains(req.PostForm.Get("scope"), "openid") {
+			t.Errorf("token request scope = %q, want no openid", req.PostForm.Get("scope"))
+		}
+	}
+
+	p = aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo", "openid", "orders")
+	p.DisableOpenID(true)
+	if scope := authQuery(t, p).Get("scope"); scope != "orders" {
+		t.Errorf("scope = %q, want the given scopes without openid", scope)
+	}
+}
+
+func TestAccessType(t *testing.T) {
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo")
+	p.SetAccessType("offline")
+	p.SetPrompt("consent")
+	q := authQuery(t, p)
+	if q.Get("access_type") != "offline" || q.Get("prompt") != "consent" {
+		t.Errorf("query = %v, want offline access with consent", q)
+	}
+	if !p.RefreshTokenAvailable() {
+		t.Error("RefreshTokenAvailable = false for offline access")
+	}
+
+	p.SetAccessType("online")
+	if q := authQuery(t, p); q.Get("access_type") != "online" {
+		t.Errorf("access_type = %q, want online", q.Get("access_type"))
+	}
+	if p.RefreshTokenAvailable() {
+		t.Error("RefreshTokenAvailable = true for online access")
+	}
+}
+
+func TestEmptyUserInfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+	}))
+	defer srv.Close()
+
+	p := aps.NewCustomisedURL(apstest.ClientID, "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+	idToken := unsignedJWT(map[string]interface{}{"sub": "subject-1", "aud": apstest.ClientID, "email": "id@example.com"})
+	session := &aps.Session{AccessToken: "token", IDToken: idToken}
+	if _, err := p.FetchUser(session); !errors.Is(err, aps.ErrEmptyUserInfo) {
+		t.Errorf("err = %v, want ErrEmptyUserInfo", err)
+	}
+
+	p.EmptyUserInfoFromIDToken(true)
+	user, err := p.FetchUser(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "subject-1" || user.Email != "id@example.com" {
+		t.Errorf("user = %+v, want the id_token claims", user)
+	}
+	if _, err := p.FetchUser(&aps.Session{AccessToken: "token"}); !errors.Is(err, aps.ErrEmptyUserInfo) {
+		t.Errorf("without id_token: err = %v, want ErrEmptyUserInfo", err)
+	}
+}
+
+func TestDefaultScopes(t *testing.T) {
+	defer func(scopes []string) { aps.DefaultScopes = scopes }(aps.DefaultScopes)
+	aps.DefaultScopes = []string{"openid", "orders"}
+
+	p := aps.New("id", "secret", "http://localhost/callback")
+	if scope := authQuery(t, p).Get("scope"); scope != "openid orders" {
+		t.Errorf("scope = %q, want the overridden defaults", scope)
+	}
+	if scope := authQuery(t, aps.New("id", "secret", "http://localhost/callback", "profile")).Get("scope"); scope != "profile" {
+		t.Errorf("scope = %q, want the given scopes", scope)
+	}
+	// Providers keep their own copy.
+	aps.DefaultScopes[1] = "changed"
+	if scope := authQuery(t, p).Get("scope"); scope != "openid orders" {
+		t.Errorf("scope = %q after changing DefaultScopes", scope)
+	}
+}
+
+func TestUserInfoFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p := aps.NewCustomisedURL(apstest.ClientID, "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+	idToken := unsignedJWT(map[string]interface{}{"sub": "subject-1", "aud": apstest.ClientID, "name": "Id Token"})
+	session := &aps.Session{AccessToken: "token", IDToken: idToken}
+	if _, err := p.FetchUser(session); err == nil || aps.IsUserInfoFallback(err) {
+		t.Errorf("fallback disabled: err = %v, want the userinfo failure", err)
+	}
+
+	p.AllowUserInfoFallback(true)
+	user, err := p.FetchUser(session)
+	if !aps.IsUserInfoFallback(err) {
+		t.Fatalf("err = %v, want a *UserInfoFallbackError", err)
+	}
+	if user.UserID != "subject-1" || user.Name != "Id Token" || user.AccessToken != "token" {
+		t.Errorf("user = %+v, want the id_token claims", user)
+	}
+	if _, err := p.FetchUser(&aps.Session{AccessToken: "token"}); err == nil || aps.IsUserInfoFallback(err) {
+		t.Errorf("without id_token: err = %v, want the userinfo failure", err)
+	}
+}
+
+func TestNickName(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		claims map[string]interface{}
+		claim  string
+		want   string
+	}{
+		{"preferred_username", map[string]interface{}{"preferred_username": "jdoe", "nickname": "JD", "login": "jd"}, "", "jdoe"},
+		{"nickname", map[string]interface{}{"nickname": "JD", "login": "jd"}, "", "JD"},
+		{"login", map[string]interface{}{"login": "jd"}, "", "jd"},
+		{"name", map[string]interface{}{}, "", "Test User"},
+		{"custom claim", map[string]interface{}{"preferred_username": "jdoe", "handle": "@jdoe"}, "handle", "@jdoe"},
+		{"missing custom claim", map[string]interface{}{"preferred_username": "jdoe"}, "handle", "jdoe"},
+	} {
+		srv := apstest.NewTestServer()
+		for k, v := range tt.claims {
+			srv.User[k] = v
+		}
+		p := srv.Provider("http://localhost/callback")
+		p.SetNickNameClaim(tt.claim)
+		user, err := p.FetchUser(&aps.Session{AccessToken: apstest.AccessToken})
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if user.NickName != tt.want {
+			t.Errorf("%s: NickName = %q, want %q", tt.name, user.NickName, tt.want)
+		}
+	}
+}
+
+func TestNewValidated(t *testing.T) {
+	const (
+		authURL  = "https://auth.example.com/authorize"
+		tokenURL = "https://auth.example.com/token"
+		userURL  = "https://auth.example.com/userinfo"
+	)
+	for _, tt := range []struct {
+		name                                                   string
+		clientID, secret, callback, authURL, tokenURL, userURL string
+		ok                                                     bool
+	}{
+		{"valid", "id", "secret", "http://localhost/callback", authURL, tokenURL, userURL, true},
+		{"loopback http endpoints", "id", "secret", "http://localhost/callback", "http://127.0.0.1/authorize", "http://localhost/token", "http://localhost/userinfo", true},
+		{"empty client ID", "", "secret", "http://localhost/callback", authURL, tokenURL, userURL, false},
+		{"empty secret", "id", "", "http://localhost/callback", authURL, tokenURL, userURL, false},
+		{"empty callback", "id", "secret", "", authURL, tokenURL, userURL, false},
+		{"empty token URL", "id", "secret", "http://localhost/callback", authURL, "", userURL, false},
+		{"plaintext remote endpoint", "id", "secret", "http://localhost/callback", authURL, "http://auth.example.com/token", userURL, false},
+	} {
+		p, err := aps.NewValidated(tt.clientID, tt.secret, tt.callback, tt.authURL, tt.tokenURL, tt.userURL)
+		if (err == nil) != tt.ok || (p != nil) != tt.ok {
+			t.Errorf("%s: provider %v, err %v", tt.name, p != nil, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package apstest provides an in-process OAuth 2.0 server and helpers for
+// testing code that uses the aps provider and its transports without a real
+// authorization server.
+package apstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"golang.org/x/oauth2"
+)
+
+// Default credentials and tokens issued by a Server.
+const (
+	ClientID     = "apstest-client"
+	ClientSecret = "apstest-secret"
+	Code         = "apstest-code"
+	AccessToken  = "apstest-access-token"
+	RefreshToken = "apstest-refresh-token"
+)
+
+// Server is an httptest server implementing the authorize, token and
+// userinfo endpoints the aps provider talks to. Its fields may be changed
+// before the first request to customise the credentials and responses.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	Code         string
+	AccessToken  string
+	RefreshToken string
+	// ExpiresIn is the access token lifetime in seconds; zero omits it.
+	ExpiresIn int
+	// User is the JSON object returned from the userinfo endpoint.
+	User map[string]interface{}
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// NewTestServer starts a Server. Callers should Close it when done.
+func NewTestServer() *Server {
+	s := &Server{
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+		Code:         Code,
+		AccessToken:  AccessToken,
+		RefreshToken: RefreshToken,
+		ExpiresIn:    3600,
+		User: map[string]interface{}{
+			"id":    "000000",
+			"email": "test@test.com",
+			"name":  "Test User",
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/userinfo", s.userinfo)
+	s.Server = httptest.NewServer(s.record(mux))
+	return s
+}
+
+// AuthURL returns the URL of the authorize endpoint.
+func (s *Server) AuthURL() string { return s.URL + "/authorize" }
+
+// TokenURL returns the URL of the token endpoint.
+func (s *Server) TokenURL() string { return s.URL + "/token" }
+
+// ProfileURL returns the URL of the userinfo endpoint.
+func (s *Server) ProfileURL() string { return s.URL + "/userinfo" }
+
+// Provider returns an aps provider configured with the server's credentials
+// and endpoints.
+func (s *Server) Provider(callbackURL string, scopes ...string) *aps.Provider {
+	return aps.NewCustomisedURL(s.ClientID, s.ClientSecret, callbackURL, s.AuthURL(), s.TokenURL(), s.ProfileURL(), scopes...)
+}
+
+// Requests returns the requests the server has received so far.
+func (s *Server) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+func (s *Server) record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || u.String() == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	q.Set("code", s.Code)
+	q.Set("state", r.Form.Get("state"))
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	if id != s.ClientID || secret != s.ClientSecret {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		if r.Form.Get("code") != s.Code {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if r.Form.Get("refresh_token") != s.RefreshToken {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	body := map[string]interface{}{
+		"access_token":  s.AccessToken,
+		"token_type":    "Bearer",
+		"refresh_token": s.RefreshToken,
+	}
+	if s.ExpiresIn > 0 {
+		body["expires_in"] = s.ExpiresIn
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	token := r.Form.Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != s.AccessToken {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.User)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// StaticTokenFetcher is an aps.TokenFetcher that always returns Token, or
+// Err when it is set.
+type StaticTokenFetcher struct {
+	Token *oauth2.Token
+	Err   error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// FetchToken implements aps.TokenFetcher.
+func (f *StaticTokenFetcher) FetchToken(existing *oauth2.Token) (*oauth2.Token, error) {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	t := *f.Token
+	return &t, nil
+}
+
+// Calls returns how many times FetchToken has been called.
+func (f *StaticTokenFetcher) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
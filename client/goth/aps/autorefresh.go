@@ -0,0 +1,105 @@
+package aps
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// defaultAutoRefreshLead is how long before expiry the background
+	// refresh runs when no refresh window is set.
+	defaultAutoRefreshLead = time.Minute
+	// autoRefreshPoll is how often the background refresh looks for a
+	// token when there is none or it doesn't expire. It also caps the
+	// backoff after failed refreshes.
+	autoRefreshPoll = time.Minute
+	// minAutoRefreshWait keeps a failing background refresh from spinning;
+	// it is the first backoff after a failure.
+	minAutoRefreshWait = time.Second
+)
+
+// StartAutoRefresh starts a goroutine that refreshes the token shortly
+// before it expires, instead of waiting for the next request to find it
+// expired. The goroutine stops when ctx is cancelled or StartAutoRefresh
+// is called again.
+func (t *authorizedTransport) StartAutoRefresh(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	t.mu.Lock()
+	if t.stopAutoRefresh != nil {
+		t.stopAutoRefresh()
+	}
+	t.stopAutoRefresh = cancel
+	t.autoRefreshDone = done
+	t.mu.Unlock()
+	go func() {
+		defer close(done)
+		t.autoRefreshLoop(ctx)
+	}()
+}
+
+func (t *authorizedTransport) autoRefreshLoop(ctx context.Context) {
+	failures := 0
+	for {
+		token := t.Token()
+		t.mu.RLock()
+		window := t.refreshLeeway + t.jitterOffset
+		t.mu.RUnlock()
+		wait, lead := autoRefreshWait(token, window, failures)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if token == nil || token.Expiry.IsZero() {
+			continue
+		}
+		// Errors are left for the next request to report; the loop
+		// tries again after a backoff.
+		if _, err := t.refreshIfNeeded(lead); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// autoRefreshWait returns how long the background refresh waits before
+// its next attempt, and the lead before the expiry of token it refreshes
+// within: window, one minute if that is zero, or half the remaining
+// lifetime of short-lived tokens. After failures consecutive failed
+// refreshes it waits at least minAutoRefreshWait, doubled for every
+// further failure up to autoRefreshPoll, so a failing server isn't hit
+// every second.
+func autoRefreshWait(token *oauth2.Token, window time.Duration, failures int) (wait, lead time.Duration) {
+	if token == nil || token.Expiry.IsZero() {
+		return autoRefreshPoll, 0
+	}
+	lead = window
+	if lead == 0 {
+		lead = defaultAutoRefreshLead
+	}
+	// Refresh short-lived tokens half way through their lifetime.
+	if remaining := token.Expiry.Sub(nowFunc()); lead > remaining/2 {
+		lead = remaining / 2
+	}
+	wait = token.Expiry.Add(-lead).Sub(nowFunc())
+	if failures > 0 {
+		backoff := minAutoRefreshWait
+		for i := 1; i < failures && backoff < autoRefreshPoll; i++ {
+			backoff *= 2
+		}
+		if backoff > autoRefreshPoll {
+			backoff = autoRefreshPoll
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+	}
+	if wait < minAutoRefreshWait {
+		wait = minAutoRefreshWait
+	}
+	return wait, lead
+}
@@ -0,0 +1,75 @@
+package aps
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fetcherFunc is a TokenFetcher calling itself.
+type fetcherFunc func(existing *oauth2.Token) (*oauth2.Token, error)
+
+func (f fetcherFunc) FetchToken(existing *oauth2.Token) (*oauth2.Token, error) { return f(existing) }
+
+func TestAutoRefreshWait(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	expiring := func(d time.Duration) *oauth2.Token {
+		return &oauth2.Token{AccessToken: "at", Expiry: now.Add(d)}
+	}
+	for _, tt := range []struct {
+		name     string
+		token    *oauth2.Token
+		window   time.Duration
+		failures int
+		wait     time.Duration
+		lead     time.Duration
+	}{
+		{"no token", nil, 0, 0, autoRefreshPoll, 0},
+		{"no expiry", &oauth2.Token{AccessToken: "at"}, 0, 0, autoRefreshPoll, 0},
+		{"default lead", expiring(time.Hour), 0, 0, 59 * time.Minute, time.Minute},
+		{"refresh window", expiring(time.Hour), 5 * time.Minute, 0, 55 * time.Minute, 5 * time.Minute},
+		{"short-lived", expiring(30 * time.Second), 0, 0, 15 * time.Second, 15 * time.Second},
+		{"expired", expiring(-time.Minute), 0, 0, time.Second, -30 * time.Second},
+		{"first failure", expiring(-time.Minute), 0, 1, time.Second, -30 * time.Second},
+		{"second failure", expiring(-time.Minute), 0, 2, 2 * time.Second, -30 * time.Second},
+		{"third failure", expiring(-time.Minute), 0, 3, 4 * time.Second, -30 * time.Second},
+		{"capped backoff", expiring(-time.Minute), 0, 7, autoRefreshPoll, -30 * time.Second},
+		{"many failures", expiring(-time.Minute), 0, 1000, autoRefreshPoll, -30 * time.Second},
+		{"failure before expiry", expiring(4 * time.Second), 0, 4, 8 * time.Second, 2 * time.Second},
+	} {
+		wait, lead := autoRefreshWait(tt.token, tt.window, tt.failures)
+		if wait != tt.wait || lead != tt.lead {
+			t.Errorf("%s: wait, lead = %v, %v, want %v, %v", tt.name, wait, lead, tt.wait, tt.lead)
+		}
+	}
+}
+
+func TestAutoRefreshFires(t *testing.T) {
+	var calls int32
+	fetcher := fetcherFunc(func(*oauth2.Token) (*oauth2.Token, error) {
+		atomic.AddInt32(&calls, 1)
+		return &oauth2.Token{AccessToken: "new", Expiry: time.Now().Add(time.Hour)}, nil
+	})
+	// The token is refreshed half way through its two second lifetime.
+	tr := &authorizedTransport{fetcher: fetcher, token: &oauth2.Token{AccessToken: "old", RefreshToken: "rt", Expiry: time.Now().Add(2 * time.Second)}}
+	tr.StartAutoRefresh(context.Background())
+	defer tr.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the token was not refreshed before it expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if token := tr.Token(); token.AccessToken != "new" {
+		t.Errorf("AccessToken = %q, want the refreshed one", token.AccessToken)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+}
@@ -0,0 +1,46 @@
+package aps
+
+import (
+	"context"
+	"sync"
+
+	"github.com/markbates/goth"
+)
+
+// FetchUsers fetches the users of many sessions at once, with at most
+// concurrency requests in flight (one if concurrency is not positive). The
+// returned users and errors are aligned with sessions: errs[i] is the error
+// for sessions[i], or nil. Sessions not yet fetched when ctx is done fail
+// with ctx.Err().
+func (p *Provider) FetchUsers(ctx context.Context, sessions []goth.Session, concurrency int) ([]goth.User, []error) {
+	users := make([]goth.User, len(sessions))
+	errs := make([]error, len(sessions))
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > len(sessions) {
+		concurrency = len(sessions)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				users[i], _, errs[i] = p.fetchUser(ctx, sessions[i])
+			}
+		}()
+	}
+	for i := range sessions {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return users, errs
+}
@@ -0,0 +1,106 @@
+package aps_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/markbates/goth"
+)
+
+// concurrencyServer answers userinfo requests after a short delay with the
+// access token as the user ID, rejecting the token "bad", and records the
+// most requests it had in flight at once.
+type concurrencyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func newConcurrencyServer() *concurrencyServer {
+	s := &concurrencyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.inFlight++
+		if s.inFlight > s.max {
+			s.max = s.inFlight
+		}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.inFlight--
+			s.mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		token := r.URL.Query().Get("access_token")
+		if token == "bad" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%q}`, token)
+	}))
+	return s
+}
+
+func (s *concurrencyServer) Max() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func TestFetchUsers(t *testing.T) {
+	srv := newConcurrencyServer()
+	defer srv.Close()
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+
+	tokens := []string{"u0", "u1", "bad", "u3", "u4", "u5", "bad", "u7", "u8", "u9"}
+	sessions := make([]goth.Session, len(tokens))
+	for i, token := range tokens {
+		sessions[i] = &aps.Session{AccessToken: token}
+	}
+	users, errs := p.FetchUsers(context.Background(), sessions, 3)
+	if len(users) != len(tokens) || len(errs) != len(tokens) {
+		t.Fatalf("%d users and %d errors for %d sessions", len(users), len(errs), len(tokens))
+	}
+	for i, token := range tokens {
+		if token == "bad" {
+			if errs[i] == nil {
+				t.Errorf("session %d: no error for a rejected token", i)
+			}
+			continue
+		}
+		if errs[i] != nil || users[i].UserID != token {
+			t.Errorf("session %d: user %q, err %v, want user %q", i, users[i].UserID, errs[i], token)
+		}
+	}
+	if max := srv.Max(); max > 3 {
+		t.Errorf("%d requests in flight at once, want at most 3", max)
+	} else if max < 2 {
+		t.Errorf("%d requests in flight at once, want them concurrent", max)
+	}
+}
+
+func TestFetchUsersCancelled(t *testing.T) {
+	srv := newConcurrencyServer()
+	defer srv.Close()
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	users, errs := p.FetchUsers(ctx, []goth.Session{&aps.Session{AccessToken: "u0"}, &aps.Session{AccessToken: "u1"}}, 0)
+	for i := range users {
+		if errs[i] != context.Canceled {
+			t.Errorf("session %d: err = %v, want context.Canceled", i, errs[i])
+		}
+	}
+	if max := srv.Max(); max != 0 {
+		t.Errorf("%d requests were sent after the context was cancelled", max)
+	}
+}
@@ -0,0 +1,153 @@
+package aps
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of sending a token or userinfo request
+// while the circuit breaker set with SetCircuitBreaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open; the authorization server is failing")
+
+// CircuitState is the state of the circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through. It is also the state of a
+	// provider without a circuit breaker.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests with ErrCircuitOpen until the cooldown
+	// has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through; its success
+	// closes the circuit and its failure opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// SetCircuitBreaker makes the provider fail fast while the authorization
+// server is failing: after threshold consecutive failed token or userinfo
+// requests, those requests fail with ErrCircuitOpen for cooldown, after
+// which one request probes the server. Failures are requests that got no
+// response or a 5xx or 429 one; errors reported by the server, such as
+// invalid_grant, show it is working, and errors of the client, such as
+// those of a token request hook, a refused endpoint or the caller's
+// context, are not counted. Transports created from the provider's
+// config share the breaker for their refreshes. A threshold of zero, the
+// default, disables the breaker.
+func (p *Provider) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	p.config.breaker = nil
+	if threshold > 0 {
+		p.config.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+// CircuitState returns the state of the circuit breaker, e.g. for metrics.
+func (p *Provider) CircuitState() CircuitState {
+	return p.config.breaker.currentState()
+}
+
+// circuitBreaker counts consecutive failures of the requests to the
+// authorization server. A nil breaker lets every request through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probing is set while the half-open probe is in flight.
+	probing bool
+}
+
+// allow returns ErrCircuitOpen if a request may not be sent now. Every
+// allowed request must be followed by a call to done.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && nowFunc().Sub(b.openedAt) >= b.cooldown {
+		b.state = CircuitHalfOpen
+	}
+	switch {
+	case b.state == CircuitOpen, b.state == CircuitHalfOpen && b.probing:
+		return ErrCircuitOpen
+	case b.state == CircuitHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of an allowed request sent with ctx: err is its
+// error and status the status of its response, if any. Errors that are not
+// failures of the server are not counted; see serverFailure.
+func (b *circuitBreaker) done(ctx context.Context, status int, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && !serverFailure(ctx, err) {
+		return
+	}
+	if err == nil && status < 500 && status != http.StatusTooManyRequests {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = nowFunc()
+	}
+}
+
+// serverFailure reports whether err, the error of a request sent with ctx,
+// shows the server failing: the request got no response, other than when
+// the caller's ctx ended, or a rate limited one. Errors of the client, such
+// as those of a token request hook or of a request guardTransport refused,
+// are not failures of the server.
+func serverFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var rateLimited *ErrRateLimited
+	if errors.As(err, &rateLimited) {
+		return true
+	}
+	// Only errors of http.Client.Do are wrapped in a *url.Error.
+	var urlErr *url.Error
+	var refused *refusedError
+	return errors.As(err, &urlErr) && !errors.As(err, &refused)
+}
+
+func (b *circuitBreaker) currentState() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && nowFunc().Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,198 @@
+package aps_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+)
+
+// flakyServer answers token requests with the status it is set to, and
+// counts them.
+type flakyServer struct {
+	*httptest.Server
+	status   int32
+	requests int32
+}
+
+func newFlakyServer(status int) *flakyServer {
+	s := &flakyServer{status: int32(status)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		switch status := int(atomic.LoadInt32(&s.status)); status {
+		case http.StatusOK:
+			fmt.Fprint(w, `{"access_token":"at","token_type":"Bearer"}`)
+		case http.StatusBadRequest:
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+		default:
+			w.WriteHeader(status)
+		}
+	}))
+	return s
+}
+
+func (s *flakyServer) setStatus(status int) { atomic.StoreInt32(&s.status, int32(status)) }
+
+func (s *flakyServer) Requests() int { return int(atomic.LoadInt32(&s.requests)) }
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer aps.SetNowFunc(func() time.Time { return now })()
+	srv := newFlakyServer(http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	p := tokenProvider(srv.URL)
+	p.SetCircuitBreaker(3, time.Minute)
+	exchange := func() error {
+		_, err := p.Exchange(context.Background(), "code")
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if state := p.CircuitState(); state != aps.CircuitClosed {
+			t.Fatalf("state after %d failures = %v, want closed", i, state)
+		}
+		if err := exchange(); err == nil || errors.Is(err, aps.ErrCircuitOpen) {
+			t.Fatalf("failure %d: err = %v", i+1, err)
+		}
+	}
+	if state := p.CircuitState(); state != aps.CircuitOpen {
+		t.Fatalf("state after the threshold = %v, want open", state)
+	}
+	if err := exchange(); !errors.Is(err, aps.ErrCircuitOpen) {
+		t.Errorf("open circuit: err = %v, want ErrCircuitOpen", err)
+	}
+	if n := srv.Requests(); n != 3 {
+		t.Errorf("%d requests reached the server, want 3", n)
+	}
+
+	// A failed probe opens the circuit again.
+	now = now.Add(time.Minute)
+	if state := p.CircuitState(); state != aps.CircuitHalfOpen {
+		t.Fatalf("state after the cooldown = %v, want half-open", state)
+	}
+	if err := exchange(); err == nil || errors.Is(err, aps.ErrCircuitOpen) {
+		t.Fatalf("probe: err = %v, want the server's failure", err)
+	}
+	if state := p.CircuitState(); state != aps.CircuitOpen {
+		t.Fatalf("state after a failed probe = %v, want open", state)
+	}
+	if err := exchange(); !errors.Is(err, aps.ErrCircuitOpen) {
+		t.Errorf("reopened circuit: err = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	srv.setStatus(http.StatusOK)
+	if err := exchange(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if state := p.CircuitState(); state != aps.CircuitClosed {
+		t.Errorf("state after a successful probe = %v, want closed", state)
+	}
+	if n := srv.Requests(); n != 5 {
+		t.Errorf("%d requests reached the server, want 5", n)
+	}
+}
+
+func TestCircuitBreakerIgnoresOAuthErrors(t *testing.T) {
+	srv := newFlakyServer(http.StatusBadRequest)
+	defer srv.Close()
+
+	p := tokenProvider(srv.URL)
+	p.SetCircuitBreaker(2, time.Minute)
+	for i := 0; i < 5; i++ {
+		if _, err := p.Exchange(context.Background(), "code"); !aps.IsInvalidGrant(err) {
+			t.Fatalf("exchange %d: err = %v, want invalid_grant", i+1, err)
+		}
+	}
+	if state := p.CircuitState(); state != aps.CircuitClosed {
+		t.Errorf("state = %v, want closed", state)
+	}
+}
+
+func TestCircuitBreakerUserInfo(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/userinfo")
+	p.SetCircuitBreaker(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := p.FetchUserByToken(context.Background(), "token"); !errors.Is(err, aps.ErrUserInfoRequest) {
+			t.Fatalf("failure %d: err = %v", i+1, err)
+		}
+	}
+	if _, err := p.FetchUserByToken(context.Background(), "token"); !errors.Is(err, aps.ErrCircuitOpen) {
+		t.Errorf("open circuit: err = %v, want ErrCircuitOpen", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%d requests reached the server, want 2", n)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	srv := newFlakyServer(http.StatusOK)
+	defer srv.Close()
+
+	p := tokenProvider(srv.URL)
+	p.SetCircuitBreaker(1, time.Hour)
+	hookErr := errors.New("no nonce")
+	p.SetTokenRequestHook(func(*http.Request) error { return hookErr })
+	for i := 0; i < 3; i++ {
+		if _, err := p.Exchange(context.Background(), "code"); !errors.Is(err, hookErr) {
+			t.Fatalf("exchange %d: err = %v, want the hook's", i+1, err)
+		}
+	}
+	p.SetTokenRequestHook(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := p.Exchange(ctx, "code"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired context: err = %v", err)
+	}
+
+	refused := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://auth.example.com/token", "http://localhost/userinfo")
+	refused.SetCircuitBreaker(1, time.Hour)
+	var insecure *aps.InsecureEndpointError
+	if _, err := refused.Exchange(context.Background(), "code"); !errors.As(err, &insecure) {
+		t.Fatalf("plaintext endpoint: err = %v, want *InsecureEndpointError", err)
+	}
+
+	if state := p.CircuitState(); state != aps.CircuitClosed {
+		t.Errorf("state = %v, want closed", state)
+	}
+	if state := refused.CircuitState(); state != aps.CircuitClosed {
+		t.Errorf("refused endpoint: state = %v, want closed", state)
+	}
+	if n := srv.Requests(); n != 0 {
+		t.Errorf("%d requests reached the server, want none", n)
+	}
+	if _, err := p.Exchange(context.Background(), "code"); err != nil {
+		t.Errorf("exchange: %v", err)
+	}
+}
+
+func TestCircuitBreakerCountsNetworkErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	p := tokenProvider(srv.URL)
+	p.SetCircuitBreaker(1, time.Hour)
+	if _, err := p.Exchange(context.Background(), "code"); err == nil || errors.Is(err, aps.ErrCircuitOpen) {
+		t.Fatalf("err = %v, want the connection's", err)
+	}
+	if state := p.CircuitState(); state != aps.CircuitOpen {
+		t.Errorf("state = %v, want open", state)
+	}
+}
@@ -0,0 +1,110 @@
+package aps
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/markbates/goth"
+)
+
+// ErrStateMismatch is returned by CompleteUserAuth when the state of the
+// callback is not the one the session's authorization was started with.
+var ErrStateMismatch = errors.New("state of the callback does not match the session")
+
+// AuthorizationError is an error response of the authorize endpoint, sent
+// back to the callback instead of a code (RFC 6749 section 4.1.2.1).
+type AuthorizationError struct {
+	// Code is the error code, such as access_denied.
+	Code        string
+	Description string
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Description == "" {
+		return "authorization failed: " + e.Code
+	}
+	return "authorization failed: " + e.Code + ": " + e.Description
+}
+
+// IsAccessDenied reports whether err is an access_denied authorization
+// error, usually because the user declined the consent.
+func IsAccessDenied(err error) bool {
+	var authErr *AuthorizationError
+	return errors.As(err, &authErr) && authErr.Code == "access_denied"
+}
+
+// IsLoginRequired reports whether err is a login_required error, returned
+// for a silent authentication with Prompt("none") when the user is not
+// logged in at the server: the flow has to be started again with a prompt.
+// It matches errors of the callback, from CompleteUserAuth, and of the
+// token endpoint, from Exchange.
+func IsLoginRequired(err error) bool {
+	return oauthErrorCode(err) == "login_required"
+}
+
+// IsInteractionRequired reports whether err is an interaction_required,
+// consent_required or account_selection_required error, returned for a
+// silent authentication with Prompt("none") when the user is logged in but
+// must interact with the server to proceed. Like IsLoginRequired, it
+// matches errors of CompleteUserAuth and Exchange.
+func IsInteractionRequired(err error) bool {
+	switch oauthErrorCode(err) {
+	case "interaction_required", "consent_required", "account_selection_required":
+		return true
+	}
+	return false
+}
+
+// oauthErrorCode returns the code of the *AuthorizationError or *OAuthError
+// in err, if any.
+func oauthErrorCode(err error) string {
+	var authErr *AuthorizationError
+	if errors.As(err, &authErr) {
+		return authErr.Code
+	}
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Code
+	}
+	return ""
+}
+
+// CompleteUserAuth handles the request to the callback URL for session,
+// the one BeginAuth returned: it checks the state, exchanges the code and
+// fetches the user. An error sent back by the authorize endpoint is
+// returned as an *AuthorizationError without attempting the exchange.
+// A POST, as sent with the form_post response mode, is read from its form
+// body instead of the query.
+func (p *Provider) CompleteUserAuth(r *http.Request, session goth.Session) (goth.User, error) {
+	params := r.URL.Query()
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return goth.User{}, err
+		}
+		params = r.PostForm
+	}
+	if code := params.Get("error"); code != "" {
+		return goth.User{}, &AuthorizationError{
+			Code:        code,
+			Description: params.Get("error_description"),
+		}
+	}
+	sess := session.(*Session)
+	if state := authURLState(sess.AuthURL); state != "" && !EqualTokens(state, params.Get("state")) {
+		return goth.User{}, ErrStateMismatch
+	}
+	if _, err := sess.Authorize(p, params); err != nil {
+		return goth.User{}, err
+	}
+	return p.FetchUser(sess)
+}
+
+// authURLState returns the state parameter of an authorize URL.
+func authURLState(authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("state")
+}
@@ -0,0 +1,154 @@
+package aps_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+// authorize sends the user agent to the authorize URL of session and
+// returns the callback URL the server redirects it to.
+func authorize(t *testing.T, session *aps.Session) *url.URL {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(session.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+func TestCompleteUserAuth(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	session, err := p.BeginAuth("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := authorize(t, session.(*aps.Session))
+	user, err := p.CompleteUserAuth(httptest.NewRequest("GET", callback.String(), nil), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "000000" || user.AccessToken != apstest.AccessToken {
+		t.Errorf("user = %+v", user)
+	}
+}
+
+func TestCompleteUserAuthFormPost(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	session, err := p.BeginAuth("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := authorize(t, session.(*aps.Session))
+	r := httptest.NewRequest("POST", "http://localhost/callback", strings.NewReader(callback.RawQuery))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := p.CompleteUserAuth(r, session); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompleteUserAuthErrors(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	session, err := p.BeginAuth("expected-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost/callback?error=access_denied&error_description=declined&state=expected-state", nil)
+	_, err = p.CompleteUserAuth(r, session)
+	var authErr *aps.AuthorizationError
+	if !aps.IsAccessDenied(err) || !errors.As(err, &authErr) || authErr.Description != "declined" {
+		t.Errorf("denied consent: err = %v, want access_denied", err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost/callback?code="+apstest.Code+"&state=forged", nil)
+	if _, err := p.CompleteUserAuth(r, session); err != aps.ErrStateMismatch {
+		t.Errorf("forged state: err = %v, want ErrStateMismatch", err)
+	}
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" {
+			t.Error("the code was exchanged despite the error")
+		}
+	}
+}
+
+func TestSilentAuthentication(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	session, err := p.BeginAuthWithOptions("state", aps.Prompt("none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(session.(*aps.Session).AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt := authURL.Query().Get("prompt"); prompt != "none" {
+		t.Errorf("prompt = %q, want none", prompt)
+	}
+
+	for _, tt := range []struct {
+		code        string
+		login       bool
+		interaction bool
+	}{
+		{"login_required", true, false},
+		{"consent_required", false, true},
+		{"interaction_required", false, true},
+		{"account_selection_required", false, true},
+		{"access_denied", false, false},
+	} {
+		r := httptest.NewRequest("GET", "http://localhost/callback?error="+tt.code+"&state=state", nil)
+		_, err := p.CompleteUserAuth(r, session)
+		if aps.IsLoginRequired(err) != tt.login || aps.IsInteractionRequired(err) != tt.interaction {
+			t.Errorf("%s: IsLoginRequired = %v, IsInteractionRequired = %v", tt.code, aps.IsLoginRequired(err), aps.IsInteractionRequired(err))
+		}
+	}
+}
+
+func TestSilentAuthenticationTokenErrors(t *testing.T) {
+	for _, tt := range []struct {
+		code        string
+		login       bool
+		interaction bool
+	}{
+		{"login_required", true, false},
+		{"interaction_required", false, true},
+		{"invalid_grant", false, false},
+	} {
+		srv := tokenEndpoint(http.StatusBadRequest, "application/json", `{"error":"`+tt.code+`"}`)
+		_, err := tokenProvider(srv.URL).Exchange(context.Background(), "code")
+		srv.Close()
+		if aps.IsLoginRequired(err) != tt.login || aps.IsInteractionRequired(err) != tt.interaction {
+			t.Errorf("%s: IsLoginRequired = %v, IsInteractionRequired = %v", tt.code, aps.IsLoginRequired(err), aps.IsInteractionRequired(err))
+		}
+	}
+	if aps.IsLoginRequired(nil) || aps.IsInteractionRequired(nil) {
+		t.Error("a nil error is classified")
+	}
+}
@@ -0,0 +1,152 @@
+package aps
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+const (
+	// clientAssertionType identifies a JWT client assertion (RFC 7523).
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// clientAssertionLifetime is how long a client assertion is valid.
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// AuthStyle is where the client ID and secret are sent to the token endpoint.
+type AuthStyle int
+
+const (
+	// AuthStyleInParams sends the client ID and secret in the POST body
+	// as client_id and client_secret. This is the default.
+	AuthStyleInParams AuthStyle = 1
+	// AuthStyleInHeader sends the client ID and secret using HTTP Basic
+	// authorization (client_secret_basic).
+	AuthStyleInHeader AuthStyle = 2
+)
+
+// SetClientAuthStyle selects how the provider sends its client credentials
+// to the token endpoint, for servers that accept only one of the methods.
+func (p *Provider) SetClientAuthStyle(style AuthStyle) {
+	p.config.authStyle = style
+}
+
+// UsePrivateKeyJWT makes the provider authenticate to the token endpoint with
+// a client assertion signed by signingKey (the private_key_jwt method of
+// OpenID Connect) instead of its client secret. kid is put in the assertion
+// header so the server can pick the matching registered key. RSA keys sign
+// with RS256, ECDSA keys with ES256, ES384 or ES512 according to their curve.
+func (p *Provider) UsePrivateKeyJWT(signingKey crypto.Signer, kid string) error {
+	if _, _, err := assertionAlgorithm(signingKey); err != nil {
+		return err
+	}
+	p.config.assertionKey = signingKey
+	p.config.assertionKeyID = kid
+	return nil
+}
+
+// setClientAssertion replaces the client secret in v with a freshly signed
+// client assertion.
+func (c *Config) setClientAssertion(v url.Values) error {
+	assertion, err := c.clientAssertion()
+	if err != nil {
+		return err
+	}
+	v.Del("client_secret")
+	v.Set("client_assertion_type", clientAssertionType)
+	v.Set("client_assertion", assertion)
+	return nil
+}
+
+// clientAssertion builds a short-lived JWT identifying the client to the
+// token endpoint.
+func (c *Config) clientAssertion() (string, error) {
+	alg, hash, err := assertionAlgorithm(c.assertionKey)
+	if err != nil {
+		return "", err
+	}
+	jti := make([]byte, 16)
+	if _, err := io.ReadFull(randReader, jti); err != nil {
+		return "", err
+	}
+	now := nowFunc()
+	header, err := json.Marshal(map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+		"kid": c.assertionKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": c.opts.ClientID,
+		"sub": c.opts.ClientID,
+		"aud": c.tokenURL,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	sig, err := c.assertionKey.Sign(randReader, h.Sum(nil), hash)
+	if err != nil {
+		return "", err
+	}
+	if pub, ok := c.assertionKey.Public().(*ecdsa.PublicKey); ok {
+		// JWS wants the raw r||s form, not the ASN.1 one crypto.Signer returns.
+		if sig, err = ecdsaRawSignature(sig, pub); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// assertionAlgorithm returns the JWS algorithm and hash used to sign with key.
+func assertionAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	if key == nil {
+		return "", 0, errors.New("a signing key should be provided")
+	}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return "ES256", crypto.SHA256, nil
+		case 384:
+			return "ES384", crypto.SHA384, nil
+		case 521:
+			return "ES512", crypto.SHA512, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unsupported signing key type %T", key.Public())
+}
+
+// ecdsaRawSignature converts an ASN.1 ECDSA signature to the fixed-size
+// r||s encoding used by JWS.
+func ecdsaRawSignature(der []byte, pub *ecdsa.PublicKey) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
@@ -0,0 +1,134 @@
+package aps
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// tokenServer answers token requests with a fixed token and keeps the form
+// of the last one.
+func tokenServer(form *url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"at","token_type":"Bearer","expires_in":3600}`)
+	}))
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		key crypto.Signer
+		alg string
+	}{
+		{testKey(t, 0), "RS256"},
+		{ecKey, "ES256"},
+	} {
+		var form url.Values
+		srv := tokenServer(&form)
+		p := newTestProvider()
+		p.config.tokenURL = srv.URL + "/token"
+		if err := p.UsePrivateKeyJWT(tt.key, "client-key"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := p.Exchange(context.Background(), "code")
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.alg, err)
+		}
+		if form.Get("client_secret") != "" {
+			t.Errorf("%s: the client secret was sent", tt.alg)
+		}
+		if got := form.Get("client_assertion_type"); got != clientAssertionType {
+			t.Errorf("%s: client_assertion_type = %q", tt.alg, got)
+		}
+		assertion, err := parseJWT(form.Get("client_assertion"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.alg, err)
+		}
+		if assertion.Header.Algorithm != tt.alg || assertion.Header.KeyID != "client-key" {
+			t.Errorf("%s: assertion header = %+v", tt.alg, assertion.Header)
+		}
+		if err := assertion.verify(tt.key.Public()); err != nil {
+			t.Errorf("%s: assertion signature: %v", tt.alg, err)
+		}
+		var claims map[string]interface{}
+		json.Unmarshal(assertion.Payload, &claims)
+		if claims["iss"] != "client" || claims["sub"] != "client" || claims["aud"] != srv.URL+"/token" || claims["jti"] == "" {
+			t.Errorf("%s: assertion claims = %v", tt.alg, claims)
+		}
+	}
+}
+
+func TestPrivateKeyJWTUnsupportedKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestProvider().UsePrivateKeyJWT(key, "kid"); err == nil {
+		t.Error("an Ed25519 key was accepted")
+	}
+}
+
+func TestClientAuthStyle(t *testing.T) {
+	var user, pass string
+	var basic bool
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, basic = r.BasicAuth()
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"at","token_type":"Bearer"}`)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name  string
+		style AuthStyle
+		basic bool
+	}{
+		{"default", 0, false},
+		{"in params", AuthStyleInParams, false},
+		{"in header", AuthStyleInHeader, true},
+	} {
+		p := NewCustomisedURL("client:1", "s&cret", "http://localhost/callback", "http://localhost/authorize", srv.URL, "http://localhost/userinfo")
+		if tt.style != 0 {
+			p.SetClientAuthStyle(tt.style)
+		}
+		if _, err := p.RefreshToken("rt"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if basic != tt.basic {
+			t.Errorf("%s: Basic authorization sent = %v, want %v", tt.name, basic, tt.basic)
+		}
+		if tt.basic {
+			// The credentials are form-encoded before Basic encoding.
+			if user != "client%3A1" || pass != "s%26cret" {
+				t.Errorf("%s: Basic credentials %q, %q", tt.name, user, pass)
+			}
+			if form.Get("client_id") != "" || form.Get("client_secret") != "" {
+				t.Errorf("%s: form = %v, want no credentials", tt.name, form)
+			}
+		} else if form.Get("client_id") != "client:1" || form.Get("client_secret") != "s&cret" {
+			t.Errorf("%s: form = %v, want the credentials", tt.name, form)
+		}
+		if form.Get("refresh_token") != "rt" {
+			t.Errorf("%s: form = %v, want the refresh token", tt.name, form)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package aps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// discoveryPath is appended to the issuer to find its metadata document.
+const discoveryPath = "/.well-known/openid-configuration"
+
+// DiscoveryDocument is the authorization server metadata published at
+// /.well-known/openid-configuration (OpenID Connect Discovery, RFC 8414).
+type DiscoveryDocument struct {
+	Issuer                 string   `json:"issuer"`
+	AuthorizationEndpoint  string   `json:"authorization_endpoint"`
+	TokenEndpoint          string   `json:"token_endpoint"`
+	UserInfoEndpoint       string   `json:"userinfo_endpoint"`
+	JWKSURI                string   `json:"jwks_uri"`
+	EndSessionEndpoint     string   `json:"end_session_endpoint"`
+	ScopesSupported        []string `json:"scopes_supported"`
+	ResponseTypesSupported []string `json:"response_types_supported"`
+	GrantTypesSupported    []string `json:"grant_types_supported"`
+}
+
+// NewFromDiscovery creates a provider for the authorization server at issuer,
+// reading its endpoints from the issuer's discovery document. The document is
+// kept on the provider and available through Discovery. Plaintext http
+// issuers and endpoints are only accepted on loopback hosts.
+func NewFromDiscovery(issuer, clientKey, secret, callbackURL string, scopes ...string) (*Provider, error) {
+	if err := checkTransportSecurity(issuer); err != nil {
+		return nil, err
+	}
+	doc, err := discover(&http.Client{Transport: DefaultTransport}, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransportSecurity(doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.UserInfoEndpoint, doc.JWKSURI, doc.EndSessionEndpoint); err != nil {
+		return nil, err
+	}
+	p, err := newProvider(clientKey, secret, callbackURL, doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.UserInfoEndpoint, scopes)
+	if err != nil {
+		return nil, err
+	}
+	p.discovery = doc
+	p.SetJWKSURL(doc.JWKSURI)
+	p.endSessionURL = doc.EndSessionEndpoint
+	return p, nil
+}
+
+// Discovery returns the discovery document the provider was created from,
+// or nil if it was not created with NewFromDiscovery.
+func (p *Provider) Discovery() *DiscoveryDocument {
+	return p.discovery
+}
+
+// discover fetches and validates the discovery document of issuer.
+func discover(client *http.Client, issuer string) (*DiscoveryDocument, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + discoveryPath
+	r, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("discovery request failed: %w", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery request to %s returned %s", wellKnown, r.Status)
+	}
+	doc := &DiscoveryDocument{}
+	if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" {
+		return nil, errors.New("discovery document has no authorization_endpoint")
+	}
+	if doc.TokenEndpoint == "" {
+		return nil, errors.New("discovery document has no token_endpoint")
+	}
+	if doc.UserInfoEndpoint == "" {
+		return nil, errors.New("discovery document has no userinfo_endpoint")
+	}
+	return doc, nil
+}
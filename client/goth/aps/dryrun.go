@@ -0,0 +1,81 @@
+package aps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+const (
+	// dryRunCode and dryRunAccessToken stand in for the authorization code
+	// and access token in the requests prepared by DryRun.
+	dryRunCode        = "DRY-RUN-CODE"
+	dryRunAccessToken = "DRY-RUN-ACCESS-TOKEN"
+)
+
+// PlannedRequests are the requests a login makes, prepared by DryRun but
+// never sent.
+type PlannedRequests struct {
+	// Authorize is the request the user's browser is redirected to.
+	Authorize *http.Request
+	// Exchange is the token request exchanging the authorization code.
+	Exchange *http.Request
+	// UserInfo is the userinfo request FetchUser makes.
+	UserInfo *http.Request
+}
+
+// DryRun prepares the requests of a login started with state, the way
+// BeginAuth, Exchange and FetchUser would make them, without sending any,
+// to check the configuration against a server. The authorization code and
+// access token, which only the server can issue, are placeholders.
+//
+// The exchange request carries the client credentials, so the planned
+// requests should not be logged where the secret would leak. It is passed
+// to the token request hook, if any, like a request about to be sent.
+func (p *Provider) DryRun(state string) (*PlannedRequests, error) {
+	session, err := p.BeginAuth(state)
+	if err != nil {
+		return nil, err
+	}
+	sess := session.(*Session)
+	authorize, err := http.NewRequest("GET", sess.AuthURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the exchange the way Session.Authorize does, so it carries the
+	// flow's scopes and code_verifier and goes through the request hook.
+	v := p.config.exchangeValues(dryRunCode, sess.exchangeRedirectURL(p), sess.exchangeOptions())
+	if err := p.config.setClientAuth(v); err != nil {
+		return nil, err
+	}
+	exchange, err := p.config.prepareTokenRequest(context.Background(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo, err := p.newUserInfoRequest(context.Background(), dryRunAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &PlannedRequests{Authorize: authorize, Exchange: exchange, UserInfo: userInfo}, nil
+}
+
+// String dumps the planned requests, with their headers and bodies, in
+// their HTTP/1.1 wire form.
+func (r *PlannedRequests) String() string {
+	var b strings.Builder
+	for _, req := range []*http.Request{r.Authorize, r.Exchange, r.UserInfo} {
+		if req == nil {
+			continue
+		}
+		dump, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			b.WriteString(err.Error())
+		}
+		b.Write(dump)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
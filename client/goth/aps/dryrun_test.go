@@ -0,0 +1,75 @@
+package aps_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+func TestDryRunExchangeMatchesSent(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetPKCE(true)
+	p.SetResource("https://api.example.com")
+	p.SetTokenRequestHook(func(req *http.Request) error {
+		req.Header.Set("X-Request-Nonce", "nonce")
+		return nil
+	})
+	// The same random bytes give the dry run and the login the same
+	// code_verifier.
+	seed := bytes.Repeat([]byte{7}, 256)
+
+	restore := aps.SetRandReader(bytes.NewReader(seed))
+	planned, err := p.DryRun("state")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore = aps.SetRandReader(bytes.NewReader(seed))
+	session, err := p.BeginAuth("state")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session.(*aps.Session)
+	callback := authorize(t, sess)
+	if _, err := sess.Authorize(p, url.Values{"code": {callback.Query().Get("code")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent *http.Request
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" {
+			sent = req
+		}
+	}
+	if sent == nil {
+		t.Fatal("no token request was sent")
+	}
+	if err := planned.Exchange.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	form := planned.Exchange.PostForm
+	if form.Get("code") != "DRY-RUN-CODE" {
+		t.Errorf("planned code = %q, want the placeholder", form.Get("code"))
+	}
+	form.Set("code", apstest.Code)
+	if !reflect.DeepEqual(form, sent.PostForm) {
+		t.Errorf("planned exchange form = %v, sent %v", form, sent.PostForm)
+	}
+	if form.Get("code_verifier") == "" || form.Get("resource") == "" {
+		t.Errorf("planned exchange form = %v, want the code_verifier and resource", form)
+	}
+	for _, name := range []string{"X-Request-Nonce", "Authorization", "Content-Type"} {
+		if got, want := planned.Exchange.Header.Get(name), sent.Header.Get(name); got != want {
+			t.Errorf("planned %s = %q, sent %q", name, got, want)
+		}
+	}
+}
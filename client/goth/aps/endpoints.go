@@ -0,0 +1,121 @@
+package aps
+
+import (
+	"net/url"
+	"strings"
+)
+
+// TrailingSlash is how SetTrailingSlash normalizes endpoint paths.
+type TrailingSlash int
+
+const (
+	// TrailingSlashKeep uses endpoints as configured. It is the default.
+	TrailingSlashKeep TrailingSlash = iota
+	// TrailingSlashStrip removes the trailing slashes of endpoint paths,
+	// so https://host/userinfo/ is requested as https://host/userinfo.
+	TrailingSlashStrip
+	// TrailingSlashAdd makes endpoint paths end with a slash, so
+	// https://host/userinfo is requested as https://host/userinfo/.
+	TrailingSlashAdd
+)
+
+// InsecureEndpointError is returned when an endpoint is a plaintext http
+// URL on a host other than a loopback one, over which tokens and secrets
+// would be sent in the clear, and AllowInsecureTransport was not called.
+type InsecureEndpointError struct {
+	Endpoint string
+}
+
+func (e *InsecureEndpointError) Error() string {
+	return "refusing plaintext http endpoint on a remote host: " + e.Endpoint
+}
+
+// AllowInsecureTransport lets endpoints be plaintext http URLs on hosts
+// other than loopback ones, e.g. inside a trusted network. By default
+// SetEndpoints, NewValidated and discovery reject them, and requests to them
+// fail, with an *InsecureEndpointError.
+func (p *Provider) AllowInsecureTransport(allow bool) {
+	p.config.allowInsecureTransport = allow
+}
+
+// SetEndpoints replaces the authorize, token and userinfo endpoints of the
+// provider. Unless AllowInsecureTransport(true) was called, http URLs are
+// only accepted for loopback hosts, such as a local development server, and
+// while InsecureSkipVerify is enabled https URLs are too, unless
+// AllowInsecureRemote(true) was called; an error leaves the endpoints
+// unchanged.
+func (p *Provider) SetEndpoints(authURL, tokenURL, profileURL string) error {
+	if err := p.config.checkEndpoints(authURL, tokenURL, profileURL); err != nil {
+		return err
+	}
+	if err := p.config.checkSkipVerify(tokenURL, profileURL); err != nil {
+		return err
+	}
+	p.config.authURL = p.trailingSlash.normalize(authURL)
+	p.config.tokenURL = p.trailingSlash.normalize(tokenURL)
+	p.profileURL = p.trailingSlash.normalize(profileURL)
+	return nil
+}
+
+// SetTrailingSlash makes the provider add or strip the trailing slash of
+// its authorize, token, userinfo and memberships endpoints, for servers
+// that only answer on one form, whichever form they were configured with.
+// It applies to the current endpoints and those set later with
+// SetEndpoints or SetMembershipsURL. Query strings are left untouched.
+func (p *Provider) SetTrailingSlash(policy TrailingSlash) {
+	p.trailingSlash = policy
+	p.config.authURL = policy.normalize(p.config.authURL)
+	p.config.tokenURL = policy.normalize(p.config.tokenURL)
+	p.profileURL = policy.normalize(p.profileURL)
+	p.membershipsURL = policy.normalize(p.membershipsURL)
+}
+
+// normalize applies the policy to the path of endpoint. Endpoints that are
+// empty or don't parse are returned as is.
+func (policy TrailingSlash) normalize(endpoint string) string {
+	if policy == TrailingSlashKeep || endpoint == "" {
+		return endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	// Work on the escaped path so escaped slashes are kept.
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	if policy == TrailingSlashAdd || path == "" {
+		path += "/"
+	}
+	if u.Path, err = url.PathUnescape(path); err != nil {
+		return endpoint
+	}
+	u.RawPath = path
+	return u.String()
+}
+
+// checkEndpoints checks endpoints with checkTransportSecurity unless
+// insecure transport is allowed.
+func (c *Config) checkEndpoints(endpoints ...string) error {
+	if c.allowInsecureTransport {
+		return nil
+	}
+	return checkTransportSecurity(endpoints...)
+}
+
+// checkTransportSecurity returns an *InsecureEndpointError for the first of
+// endpoints that is plaintext http on a remote host. Empty endpoints are
+// skipped.
+func checkTransportSecurity(endpoints ...string) error {
+	for _, endpoint := range endpoints {
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "http" && !isLoopback(u.Hostname()) {
+			return &InsecureEndpointError{Endpoint: endpoint}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package aps_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+const (
+	remoteAuthURL    = "http://auth.example.com/authorize"
+	remoteTokenURL   = "http://auth.example.com/token"
+	remoteProfileURL = "http://auth.example.com/userinfo"
+)
+
+func TestNewValidatedRejectsPlaintextRemote(t *testing.T) {
+	_, err := aps.NewValidated("id", "secret", "http://localhost/callback", remoteAuthURL, remoteTokenURL, remoteProfileURL)
+	var insecure *aps.InsecureEndpointError
+	if !errors.As(err, &insecure) {
+		t.Fatalf("err = %v, want an *InsecureEndpointError", err)
+	}
+}
+
+func TestNewCustomisedURLPlaintextRemote(t *testing.T) {
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", remoteAuthURL, remoteTokenURL, remoteProfileURL)
+	_, err := p.FetchUserByToken(context.Background(), secretAccessToken)
+	var insecure *aps.InsecureEndpointError
+	if !errors.As(err, &insecure) {
+		t.Fatalf("userinfo: err = %v, want an *InsecureEndpointError", err)
+	}
+	if strings.Contains(err.Error(), secretAccessToken) {
+		t.Errorf("error contains the access token: %v", err)
+	}
+	_, err = p.AuthenticatedRequest(context.Background(), validToken(), "GET", "http://api.example.com/data", nil)
+	if !errors.As(err, &insecure) {
+		t.Errorf("API request: err = %v, want an *InsecureEndpointError", err)
+	}
+
+	p.AllowInsecureTransport(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// The request is sent now; where it goes doesn't matter.
+	p.SetEndpoints(remoteAuthURL, remoteTokenURL, "http://192.0.2.1/userinfo")
+	if _, err := p.FetchUserByToken(ctx, secretAccessToken); errors.As(err, &insecure) {
+		t.Errorf("allowed insecure transport: err = %v", err)
+	}
+}
+
+func TestSetEndpointsPlaintextRemote(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	err := p.SetEndpoints(remoteAuthURL, remoteTokenURL, remoteProfileURL)
+	var insecure *aps.InsecureEndpointError
+	if !errors.As(err, &insecure) || insecure.Endpoint != remoteAuthURL {
+		t.Fatalf("err = %v, want an *InsecureEndpointError for %s", err, remoteAuthURL)
+	}
+	// The endpoints are left unchanged.
+	if _, err := p.FetchUserByToken(context.Background(), apstest.AccessToken); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrailingSlashNormalization(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		policy   aps.TrailingSlash
+		endpoint string
+		want     string
+	}{
+		{"keep without slash", aps.TrailingSlashKeep, "http://localhost/authorize", "/authorize"},
+		{"keep with slash", aps.TrailingSlashKeep, "http://localhost/authorize/", "/authorize/"},
+		{"strip", aps.TrailingSlashStrip, "http://localhost/authorize/", "/authorize"},
+		{"strip several", aps.TrailingSlashStrip, "http://localhost/authorize//", "/authorize"},
+		{"strip without slash", aps.TrailingSlashStrip, "http://localhost/authorize", "/authorize"},
+		{"add", aps.TrailingSlashAdd, "http://localhost/authorize", "/authorize/"},
+		{"add with slash", aps.TrailingSlashAdd, "http://localhost/authorize/", "/authorize/"},
+		{"strip root", aps.TrailingSlashStrip, "http://localhost/", "/"},
+		{"add to empty path", aps.TrailingSlashAdd, "http://localhost", "/"},
+		{"escaped slash kept", aps.TrailingSlashStrip, "http://localhost/tenants/a%2Fb/authorize/", "/tenants/a%2Fb/authorize"},
+		{"query kept", aps.TrailingSlashStrip, "http://localhost/authorize/?tenant=a", "/authorize"},
+	} {
+		p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", tt.endpoint, "http://localhost/token", "http://localhost/userinfo")
+		p.SetTrailingSlash(tt.policy)
+		session, err := p.BeginAuth("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(session.(*aps.Session).AuthURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.EscapedPath() != tt.want {
+			t.Errorf("%s: path = %q, want %q", tt.name, u.EscapedPath(), tt.want)
+		}
+		if strings.Contains(tt.endpoint, "?") && u.Query().Get("tenant") != "a" {
+			t.Errorf("%s: query of %s lost", tt.name, u)
+		}
+	}
+}
+
+func TestSetTrailingSlashLaterEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/memberships"):
+			fmt.Fprint(w, `{"memberships":[]}`)
+		default:
+			fmt.Fprint(w, `{"id":"1"}`)
+		}
+	}))
+	defer srv.Close()
+
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/userinfo")
+	p.SetTrailingSlash(aps.TrailingSlashAdd)
+	if _, err := p.FetchUserByToken(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetEndpoints(srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/v2/userinfo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.FetchUserByToken(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	p.SetMembershipsURL(srv.URL + "/memberships")
+	if _, err := p.FetchUserMemberships(context.Background(), validToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"/userinfo/", "/v2/userinfo/", "/memberships/"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,26 @@
+package aps
+
+// categoryError is an error classified under a sentinel: errors.Is matches
+// both the sentinel and the errors err wraps, and errors.As still finds
+// typed errors such as *OAuthError in err.
+type categoryError struct {
+	category error
+	err      error
+}
+
+// wrapError classifies err under category.
+func wrapError(category, err error) error {
+	return &categoryError{category: category, err: err}
+}
+
+func (e *categoryError) Error() string {
+	return e.category.Error() + ": " + e.err.Error()
+}
+
+func (e *categoryError) Is(target error) bool {
+	return target == e.category
+}
+
+func (e *categoryError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,148 @@
+package aps_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+)
+
+func TestUserInfoErrorCategories(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  int
+		body    string
+		want    error
+		notWant error
+	}{
+		{"server error", http.StatusBadGateway, "", aps.ErrUserInfoRequest, aps.ErrDecodeUserInfo},
+		{"rate limited", http.StatusTooManyRequests, "", aps.ErrUserInfoRequest, aps.ErrDecodeUserInfo},
+		{"malformed body", http.StatusOK, `{"id":`, aps.ErrDecodeUserInfo, aps.ErrUserInfoRequest},
+		{"wrong types", http.StatusOK, `{"id":"1","email":42}`, aps.ErrDecodeUserInfo, aps.ErrUserInfoRequest},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+		_, err := p.FetchUserByToken(context.Background(), "token")
+		srv.Close()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+		if errors.Is(err, tt.notWant) {
+			t.Errorf("%s: err = %v also matches %v", tt.name, err, tt.notWant)
+		}
+	}
+}
+
+func TestUserInfoErrorUnwraps(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	userInfoURL := srv.URL + "/userinfo"
+	srv.Close()
+
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", userInfoURL)
+	_, err := p.FetchUserByToken(context.Background(), "token")
+	if !errors.Is(err, aps.ErrUserInfoRequest) {
+		t.Errorf("err = %v, want ErrUserInfoRequest", err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("err = %v does not wrap the *url.Error", err)
+	}
+}
+
+func TestTokenExchangeErrorCategory(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		status    int
+		body      string
+		wantOAuth bool
+	}{
+		{"invalid grant", http.StatusBadRequest, `{"error":"invalid_grant"}`, true},
+		{"unauthorized client", http.StatusUnauthorized, `{"error":"invalid_client"}`, true},
+		{"server error", http.StatusInternalServerError, "down", false},
+	} {
+		srv := tokenEndpoint(tt.status, "application/json", tt.body)
+		_, err := tokenProvider(srv.URL).Exchange(context.Background(), "code")
+		srv.Close()
+		if !errors.Is(err, aps.ErrTokenExchange) {
+			t.Errorf("%s: err = %v, want ErrTokenExchange", tt.name, err)
+		}
+		if errors.Is(err, aps.ErrUserInfoRequest) {
+			t.Errorf("%s: err = %v matches ErrUserInfoRequest", tt.name, err)
+		}
+		var oauthErr *aps.OAuthError
+		if errors.As(err, &oauthErr) != tt.wantOAuth {
+			t.Errorf("%s: errors.As(*OAuthError) = %v, want %v", tt.name, !tt.wantOAuth, tt.wantOAuth)
+		}
+	}
+}
+
+// rejectingServer answers every request with status and the given
+// WWW-Authenticate headers.
+func rejectingServer(status int, challenges ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range challenges {
+			w.Header().Add("WWW-Authenticate", c)
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestUserInfoRejected(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		status            int
+		challenges        []string
+		invalidToken      bool
+		insufficientScope bool
+	}{
+		{"invalid token", http.StatusUnauthorized, []string{`Bearer error="invalid_token"`}, true, false},
+		{"insufficient scope", http.StatusForbidden, []string{`Bearer error="insufficient_scope", scope="email"`}, false, true},
+		{"other challenge first", http.StatusUnauthorized, []string{`Basic realm="site"`, `Bearer error=invalid_token`}, true, false},
+		{"no challenge", http.StatusUnauthorized, nil, false, false},
+	} {
+		srv := rejectingServer(tt.status, tt.challenges...)
+		p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+		_, err := p.FetchUser(&aps.Session{AccessToken: "token"})
+		srv.Close()
+		var authErr *aps.UserInfoAuthError
+		if !errors.As(err, &authErr) || authErr.StatusCode != tt.status {
+			t.Errorf("%s: err = %v, want a *UserInfoAuthError with status %d", tt.name, err, tt.status)
+			continue
+		}
+		if aps.IsInvalidToken(err) != tt.invalidToken || aps.IsInsufficientScope(err) != tt.insufficientScope {
+			t.Errorf("%s: IsInvalidToken = %v, IsInsufficientScope = %v", tt.name, aps.IsInvalidToken(err), aps.IsInsufficientScope(err))
+		}
+	}
+}
+
+func TestUserInfoAuthErrorParams(t *testing.T) {
+	srv := rejectingServer(http.StatusForbidden,
+		`Bearer realm="example, inc.", error="insufficient_scope", error_description="The \"email\" scope is required", scope="openid email"`)
+	defer srv.Close()
+
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL)
+	_, err := p.FetchUser(&aps.Session{AccessToken: "token"})
+	var authErr *aps.UserInfoAuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("err = %v, want a *UserInfoAuthError", err)
+	}
+	want := &aps.UserInfoAuthError{
+		StatusCode:  http.StatusForbidden,
+		Code:        "insufficient_scope",
+		Description: `The "email" scope is required`,
+		Realm:       "example, inc.",
+		Scopes:      []string{"openid", "email"},
+	}
+	if !reflect.DeepEqual(authErr, want) {
+		t.Errorf("err = %+v, want %+v", authErr, want)
+	}
+}
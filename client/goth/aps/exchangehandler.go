@@ -0,0 +1,111 @@
+package aps
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenExchangeHandler returns a handler exchanging authorization codes for
+// single-page applications, which must not hold the client secret: the SPA
+// POSTs the code, its PKCE code_verifier and optionally the redirect_uri as
+// a form, and gets the token response of the server back as JSON. The
+// redirect_uri defaults to CallbackURL and must be allowed as for
+// BeginAuthWithRedirect and registered, if SetRegisteredRedirectURIs was
+// used. Errors are answered in the OAuth error format.
+func (p *Provider) TokenExchangeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeTokenError(w, http.StatusMethodNotAllowed, "invalid_request", "the token exchange must be a POST")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+			return
+		}
+		code, verifier := r.PostForm.Get("code"), r.PostForm.Get("code_verifier")
+		if code == "" {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", "missing code")
+			return
+		}
+		if !validCodeVerifier(verifier) {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", "missing or malformed code_verifier")
+			return
+		}
+		redirectURL := r.PostForm.Get("redirect_uri")
+		if redirectURL == "" {
+			redirectURL = p.CallbackURL
+		}
+		if !p.redirectAllowed(redirectURL) || !p.redirectRegistered(redirectURL) {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not allowed")
+			return
+		}
+
+		token, err := p.exchange(r.Context(), code, redirectURL, oauth2.SetAuthURLParam("code_verifier", verifier))
+		if err != nil {
+			var oauthErr *OAuthError
+			if errors.As(err, &oauthErr) {
+				writeTokenError(w, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+				return
+			}
+			writeTokenError(w, http.StatusBadGateway, "server_error", "the token exchange failed")
+			return
+		}
+
+		resp := struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type,omitempty"`
+			RefreshToken string `json:"refresh_token,omitempty"`
+			ExpiresIn    int64  `json:"expires_in,omitempty"`
+			IDToken      string `json:"id_token,omitempty"`
+			Scope        string `json:"scope,omitempty"`
+		}{
+			AccessToken:  token.AccessToken,
+			TokenType:    token.TokenType,
+			RefreshToken: token.RefreshToken,
+		}
+		if !token.Expiry.IsZero() {
+			resp.ExpiresIn = int64(token.Expiry.Sub(nowFunc()) / time.Second)
+		}
+		resp.IDToken, _ = token.Extra("id_token").(string)
+		resp.Scope, _ = token.Extra("scope").(string)
+		writeTokenJSON(w, http.StatusOK, resp)
+	}
+}
+
+// validCodeVerifier reports whether v is a PKCE code_verifier: 43 to 128
+// unreserved characters (RFC 7636 section 4.1).
+func validCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; !isAlphaNum(c) && c != '-' && c != '.' && c != '_' && c != '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTokenError answers with an OAuth error response (RFC 6749 section
+// 5.2).
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	writeTokenJSON(w, status, struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}{code, description})
+}
+
+// writeTokenJSON writes v as a JSON token endpoint response, which must
+// not be cached.
+func writeTokenJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,108 @@
+package aps_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+// testVerifier is a valid PKCE code_verifier.
+const testVerifier = "dBjftJeZ4CVP-mJ92K9TtxJK-mRHb4p0j5ZnNSvd9Ms"
+
+// postExchange POSTs form to handler and returns the response and its
+// decoded JSON body.
+func postExchange(t *testing.T, handler http.Handler, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := httptest.NewRequest("POST", "http://localhost/exchange", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response %q is not JSON: %v", w.Body.String(), err)
+	}
+	return w, body
+}
+
+func TestTokenExchangeHandler(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	handler := srv.Provider("http://localhost/callback").TokenExchangeHandler()
+
+	w, body := postExchange(t, handler, url.Values{"code": {apstest.Code}, "code_verifier": {testVerifier}})
+	if w.Code != http.StatusOK || body["access_token"] != apstest.AccessToken {
+		t.Fatalf("%d %v, want the access token", w.Code, body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("the token response may be cached")
+	}
+	if body["expires_in"] == nil {
+		t.Error("expires_in is missing")
+	}
+	var token url.Values
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" {
+			token = req.PostForm
+		}
+	}
+	if token.Get("code_verifier") != testVerifier || token.Get("redirect_uri") != "http://localhost/callback" {
+		t.Errorf("token request form = %v", token)
+	}
+}
+
+func TestTokenExchangeHandlerMethod(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	handler := srv.Provider("http://localhost/callback").TokenExchangeHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/exchange?code="+apstest.Code, nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("GET: %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestTokenExchangeHandlerErrors(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	p := srv.Provider("http://localhost/callback")
+	p.SetRegisteredRedirectURIs("http://localhost/callback")
+	handler := p.TokenExchangeHandler()
+
+	for _, tt := range []struct {
+		name   string
+		form   url.Values
+		status int
+		code   string
+	}{
+		{"missing code", url.Values{"code_verifier": {testVerifier}}, http.StatusBadRequest, "invalid_request"},
+		{"missing verifier", url.Values{"code": {apstest.Code}}, http.StatusBadRequest, "invalid_request"},
+		{"short verifier", url.Values{"code": {apstest.Code}, "code_verifier": {"short"}}, http.StatusBadRequest, "invalid_request"},
+		{"verifier with reserved characters", url.Values{"code": {apstest.Code}, "code_verifier": {strings.Repeat("a", 42) + "/"}}, http.StatusBadRequest, "invalid_request"},
+		{"unregistered redirect_uri", url.Values{"code": {apstest.Code}, "code_verifier": {testVerifier}, "redirect_uri": {"http://localhost/other"}}, http.StatusBadRequest, "invalid_request"},
+		{"foreign redirect_uri", url.Values{"code": {apstest.Code}, "code_verifier": {testVerifier}, "redirect_uri": {"https://evil.example.com/callback"}}, http.StatusBadRequest, "invalid_request"},
+		{"wrong code", url.Values{"code": {"wrong"}, "code_verifier": {testVerifier}}, http.StatusBadRequest, "invalid_grant"},
+	} {
+		w, body := postExchange(t, handler, tt.form)
+		if w.Code != tt.status || body["error"] != tt.code {
+			t.Errorf("%s: %d %v, want %d %s", tt.name, w.Code, body, tt.status, tt.code)
+		}
+		if body["access_token"] != nil {
+			t.Errorf("%s: an access token was returned", tt.name)
+		}
+	}
+
+	exchanges := 0
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" {
+			exchanges++
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("%d codes were exchanged, want only the wrong one", exchanges)
+	}
+}
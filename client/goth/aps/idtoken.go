@@ -0,0 +1,204 @@
+package aps
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultClockSkew is the clock skew tolerated when checking id_token times.
+const defaultClockSkew = time.Minute
+
+// idTokenClaims holds the id_token claims the provider relies on.
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	IssuedAt        *int64   `json:"iat"`
+	NotBefore       *int64   `json:"nbf"`
+	Expiry          *int64   `json:"exp"`
+	AccessTokenHash string   `json:"at_hash"`
+
+	// hash is the hash function of the id_token's signing algorithm, zero
+	// if it is unknown.
+	hash crypto.Hash
+}
+
+// audience is the aud claim, which may be a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("aud claim must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks an id_token just received from the token endpoint:
+// on top of the checks of verifyIDTokenPayload, its iat and nbf claims must
+// be acceptable now, which guards against replays.
+func (p *Provider) verifyIDToken(raw string) (*idTokenClaims, error) {
+	claims, _, err := p.verifyIDTokenPayload(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verifyIssuedAt(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifyIDTokenPayload checks the id_token's signature, when a JWKS URL is
+// configured, that it was issued to this client and that it hasn't
+// expired, and returns its claims, also as JSON. An encrypted id_token is
+// decrypted first. It is used on its own to read the id_token stored on a
+// session, which was checked by verifyIDToken when it was received.
+func (p *Provider) verifyIDTokenPayload(raw string) (*idTokenClaims, json.RawMessage, error) {
+	if isJWE(raw) {
+		if p.idTokenDecrypter == nil {
+			return nil, nil, ErrEncryptedIDToken
+		}
+		inner, err := decryptJWE(raw, p.idTokenDecrypter)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = string(inner)
+	}
+	t, err := p.verifyJWT(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := &idTokenClaims{}
+	if err := json.Unmarshal(t.Payload, claims); err != nil {
+		return nil, nil, err
+	}
+	claims.hash, _ = t.hash()
+	if err := p.verifyAudience(claims); err != nil {
+		return nil, nil, err
+	}
+	if err := p.verifyExpiry(claims); err != nil {
+		return nil, nil, err
+	}
+	return claims, t.Payload, nil
+}
+
+// verifyAccessTokenHash checks that the at_hash claim, if any, matches
+// accessToken: it must be the base64url encoding of the left half of the
+// access token's hash, using the hash of the id_token's signing algorithm.
+func (c *idTokenClaims) verifyAccessTokenHash(accessToken string) error {
+	if c.AccessTokenHash == "" {
+		return nil
+	}
+	if c.hash == 0 || !c.hash.Available() {
+		return errors.New("cannot verify the at_hash of an id_token with an unsupported algorithm")
+	}
+	h := c.hash.New()
+	h.Write([]byte(accessToken))
+	sum := h.Sum(nil)
+	if !EqualTokens(base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), c.AccessTokenHash) {
+		return errors.New("id_token at_hash does not match the access token")
+	}
+	return nil
+}
+
+// SetIDTokenMaxAge rejects id_tokens issued more than maxAge ago, as a
+// replay protection. It applies when a token is received, not to the
+// id_token stored on a session, which remains usable until it expires.
+// Zero, the default, disables the check.
+func (p *Provider) SetIDTokenMaxAge(maxAge time.Duration) {
+	p.idTokenMaxAge = maxAge
+}
+
+// SetClockSkew sets how far the server's clock may differ from ours when
+// checking id_token iat, nbf and exp claims. It defaults to one minute.
+func (p *Provider) SetClockSkew(skew time.Duration) {
+	p.clockSkew = &skew
+}
+
+// RequireIssuedAt makes id_tokens without an iat claim be rejected. By
+// default they are accepted.
+func (p *Provider) RequireIssuedAt(require bool) {
+	p.requireIssuedAt = require
+}
+
+// clockSkewOrDefault returns the clock skew tolerated when checking
+// id_token times.
+func (p *Provider) clockSkewOrDefault() time.Duration {
+	if p.clockSkew != nil {
+		return *p.clockSkew
+	}
+	return defaultClockSkew
+}
+
+// verifyExpiry rejects expired id_tokens.
+func (p *Provider) verifyExpiry(claims *idTokenClaims) error {
+	if claims.Expiry == nil {
+		return nil
+	}
+	exp := time.Unix(*claims.Expiry, 0)
+	if !nowFunc().Add(-p.clockSkewOrDefault()).Before(exp) {
+		return fmt.Errorf("id_token expired at %s", exp.UTC())
+	}
+	return nil
+}
+
+// verifyIssuedAt rejects id_tokens issued in the future, not valid yet, or
+// older than the configured maximum age.
+func (p *Provider) verifyIssuedAt(claims *idTokenClaims) error {
+	now := nowFunc()
+	skew := p.clockSkewOrDefault()
+	if claims.NotBefore != nil && now.Add(skew).Before(time.Unix(*claims.NotBefore, 0)) {
+		return fmt.Errorf("id_token is not valid before %s", time.Unix(*claims.NotBefore, 0).UTC())
+	}
+	if claims.IssuedAt == nil {
+		if p.requireIssuedAt {
+			return errors.New("id_token has no iat claim")
+		}
+		return nil
+	}
+	iat := time.Unix(*claims.IssuedAt, 0)
+	if now.Add(skew).Before(iat) {
+		return fmt.Errorf("id_token iat %s is in the future", iat.UTC())
+	}
+	if p.idTokenMaxAge > 0 && now.Sub(iat) > p.idTokenMaxAge+skew {
+		return fmt.Errorf("id_token was issued at %s, more than %s ago", iat.UTC(), p.idTokenMaxAge)
+	}
+	return nil
+}
+
+// verifyAudience guards against tokens issued to another client being
+// substituted for ours: aud must contain our client ID, and azp, which is
+// required when there are several audiences, must equal it.
+func (p *Provider) verifyAudience(claims *idTokenClaims) error {
+	clientID := p.config.opts.ClientID
+	if !claims.Audience.contains(clientID) {
+		return fmt.Errorf("id_token audience %q does not include client ID %q", []string(claims.Audience), clientID)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty == "" {
+		return fmt.Errorf("id_token has multiple audiences but no azp claim")
+	}
+	if claims.AuthorizedParty != "" && claims.AuthorizedParty != clientID {
+		return fmt.Errorf("id_token azp %q does not match client ID %q", claims.AuthorizedParty, clientID)
+	}
+	return nil
+}
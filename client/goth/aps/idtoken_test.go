@@ -0,0 +1,186 @@
+package aps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyIDTokenAudience(t *testing.T) {
+	p := newTestProvider()
+	for _, tt := range []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{"single audience", map[string]interface{}{"aud": "client"}, true},
+		{"audience list", map[string]interface{}{"aud": []string{"client", "api"}, "azp": "client"}, true},
+		{"other audience", map[string]interface{}{"aud": "other"}, false},
+		{"missing audience", map[string]interface{}{}, false},
+		{"several audiences without azp", map[string]interface{}{"aud": []string{"client", "api"}}, false},
+		{"azp of another client", map[string]interface{}{"aud": "client", "azp": "other"}, false},
+		{"malformed audience", map[string]interface{}{"aud": 42}, false},
+	} {
+		_, err := p.verifyIDToken(signTestJWT(t, testKey(t, 0), "", tt.claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestVerifyIDTokenIssuedAt(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	zero := time.Duration(0)
+	for _, tt := range []struct {
+		name    string
+		claims  map[string]interface{}
+		maxAge  time.Duration
+		skew    *time.Duration
+		require bool
+		ok      bool
+	}{
+		{"issued now", map[string]interface{}{"iat": at(0)}, 0, nil, false, true},
+		{"issued within the default skew", map[string]interface{}{"iat": at(30 * time.Second)}, 0, nil, false, true},
+		{"issued in the future", map[string]interface{}{"iat": at(2 * time.Minute)}, 0, nil, false, false},
+		{"future without skew", map[string]interface{}{"iat": at(time.Second)}, 0, &zero, false, false},
+		{"not valid yet", map[string]interface{}{"iat": at(0), "nbf": at(5 * time.Minute)}, 0, nil, false, false},
+		{"old without max age", map[string]interface{}{"iat": at(-24 * time.Hour)}, 0, nil, false, true},
+		{"within max age", map[string]interface{}{"iat": at(-4 * time.Minute)}, 5 * time.Minute, &zero, false, true},
+		{"older than max age", map[string]interface{}{"iat": at(-6 * time.Minute)}, 5 * time.Minute, &zero, false, false},
+		{"max age plus skew", map[string]interface{}{"iat": at(-5*time.Minute - 30*time.Second)}, 5 * time.Minute, nil, false, true},
+		{"missing iat", map[string]interface{}{}, 0, nil, false, true},
+		{"missing required iat", map[string]interface{}{}, 0, nil, true, false},
+	} {
+		p := newTestProvider()
+		p.SetIDTokenMaxAge(tt.maxAge)
+		if tt.skew != nil {
+			p.SetClockSkew(*tt.skew)
+		}
+		p.RequireIssuedAt(tt.require)
+		tt.claims["aud"] = "client"
+		_, err := p.verifyIDToken(signTestJWT(t, testKey(t, 0), "", tt.claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+// atHash returns the RS256 at_hash of accessToken.
+func atHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func TestVerifyAccessTokenHash(t *testing.T) {
+	p := newTestProvider()
+	for _, tt := range []struct {
+		name   string
+		atHash string
+		ok     bool
+	}{
+		{"matching", atHash("at"), true},
+		{"absent", "", true},
+		{"of another token", atHash("other"), false},
+	} {
+		claims := map[string]interface{}{"aud": "client"}
+		if tt.atHash != "" {
+			claims["at_hash"] = tt.atHash
+		}
+		parsed, err := p.verifyIDToken(signTestJWT(t, testKey(t, 0), "", claims))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := parsed.verifyAccessTokenHash("at"); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestExchangeChecksAccessTokenHash(t *testing.T) {
+	var idToken string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"at","token_type":"Bearer","id_token":%q}`, idToken)
+	}))
+	defer srv.Close()
+	p := newTestProvider()
+	p.config.tokenURL = srv.URL
+
+	idToken = signTestJWT(t, testKey(t, 0), "", map[string]interface{}{"aud": "client", "at_hash": atHash("at")})
+	if _, err := p.Exchange(context.Background(), "code"); err != nil {
+		t.Errorf("matching at_hash: %v", err)
+	}
+	idToken = signTestJWT(t, testKey(t, 0), "", map[string]interface{}{"aud": "client", "at_hash": atHash("substituted")})
+	if _, err := p.Exchange(context.Background(), "code"); err == nil {
+		t.Error("mismatched at_hash was accepted")
+	}
+}
+
+func TestVerifyIDTokenExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	for _, tt := range []struct {
+		name string
+		exp  interface{}
+		ok   bool
+	}{
+		{"valid", now.Add(time.Hour).Unix(), true},
+		{"no exp", nil, true},
+		{"expired within the skew", now.Add(-30 * time.Second).Unix(), true},
+		{"expired", now.Add(-2 * time.Minute).Unix(), false},
+	} {
+		claims := map[string]interface{}{"aud": "client"}
+		if tt.exp != nil {
+			claims["exp"] = tt.exp
+		}
+		_, _, err := newTestProvider().verifyIDTokenPayload(signTestJWT(t, testKey(t, 0), "", claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestStoredIDTokenOlderThanMaxAge(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No id, so the subject is read from the id_token.
+		fmt.Fprint(w, `{"name":"Test User"}`)
+	}))
+	defer srv.Close()
+	p := newTestProvider()
+	p.profileURL = srv.URL
+	p.SetIDTokenMaxAge(5 * time.Minute)
+
+	idToken := signTestJWT(t, testKey(t, 0), "", map[string]interface{}{
+		"aud": "client", "sub": "42", "roles": []string{"admin"},
+		"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(time.Hour).Unix(),
+	})
+	if _, err := p.verifyIDToken(idToken); err == nil {
+		t.Fatal("an id_token older than the maximum age was received")
+	}
+	sess := &Session{AccessToken: "at", IDToken: idToken, ExpiresAt: now.Add(time.Hour)}
+	user, err := p.FetchUser(sess)
+	if err != nil {
+		t.Fatalf("stored id_token past the maximum age: %v", err)
+	}
+	if user.UserID != "42" {
+		t.Errorf("UserID = %q, want 42", user.UserID)
+	}
+	if roles, _ := user.RawData["roles"].([]string); len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("roles = %v, want the id_token's", user.RawData["roles"])
+	}
+
+	now = now.Add(2 * time.Hour)
+	sess.ExpiresAt = now.Add(time.Hour)
+	if _, err := p.FetchUser(sess); err == nil {
+		t.Error("the subject of an expired id_token was used")
+	}
+}
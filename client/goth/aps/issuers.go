@@ -0,0 +1,120 @@
+package aps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxIssuerKeySets bounds the number of issuers whose key sets are cached;
+// the least recently used one is dropped to make room.
+const maxIssuerKeySets = 32
+
+// issuerKeySet is the cached key set of a trusted issuer.
+type issuerKeySet struct {
+	keys     *keySet
+	lastUsed time.Time
+}
+
+// SetTrustedIssuers makes tokens be verified with the keys of the issuer in
+// their iss claim, for multi-tenant servers where each tenant is an issuer
+// with its own JWKS. trusted reports whether an issuer is one of ours; the
+// JWKS of a trusted issuer is found through its discovery document and
+// cached, and tokens from other issuers are rejected. Tokens without an iss
+// claim are still verified with the JWKS URL set on the provider, if any.
+// Nil, the default, disables this.
+func (p *Provider) SetTrustedIssuers(trusted func(issuer string) bool) {
+	p.issuerMu.Lock()
+	defer p.issuerMu.Unlock()
+	p.trustedIssuer = trusted
+	p.issuerKeys = nil
+}
+
+// keySetFor returns the key set verifying t: that of its issuer when
+// issuers are trusted, the provider's otherwise, or nil if there is none.
+func (p *Provider) keySetFor(t *jwt) (*keySet, error) {
+	p.issuerMu.Lock()
+	trusted := p.trustedIssuer
+	p.issuerMu.Unlock()
+	if trusted == nil {
+		return p.jwks, nil
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(t.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	if claims.Issuer == "" {
+		if p.jwks == nil {
+			return nil, errors.New("JWT has no iss claim to find its keys by")
+		}
+		return p.jwks, nil
+	}
+	if !trusted(claims.Issuer) {
+		return nil, fmt.Errorf("JWT issuer %q is not trusted", claims.Issuer)
+	}
+	return p.issuerKeySet(claims.Issuer)
+}
+
+// issuerKeySet returns the cached key set of issuer, discovering its JWKS
+// URL on first use.
+func (p *Provider) issuerKeySet(issuer string) (*keySet, error) {
+	p.issuerMu.Lock()
+	if entry, ok := p.issuerKeys[issuer]; ok {
+		entry.lastUsed = nowFunc()
+		p.issuerMu.Unlock()
+		return entry.keys, nil
+	}
+	p.issuerMu.Unlock()
+
+	// Discover without holding the lock, so a slow issuer doesn't hold up
+	// the others. Concurrent first uses may discover twice; one wins.
+	if err := p.config.checkEndpoints(issuer); err != nil {
+		return nil, err
+	}
+	doc, err := discover(p.config.httpClient(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.config.checkEndpoints(doc.JWKSURI); err != nil {
+		return nil, err
+	}
+	if doc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %q has no jwks_uri", issuer)
+	}
+
+	p.issuerMu.Lock()
+	defer p.issuerMu.Unlock()
+	if entry, ok := p.issuerKeys[issuer]; ok {
+		entry.lastUsed = nowFunc()
+		return entry.keys, nil
+	}
+	if p.issuerKeys == nil {
+		p.issuerKeys = map[string]*issuerKeySet{}
+	}
+	if len(p.issuerKeys) >= maxIssuerKeySets {
+		var oldest string
+		for iss, entry := range p.issuerKeys {
+			if oldest == "" || entry.lastUsed.Before(p.issuerKeys[oldest].lastUsed) {
+				oldest = iss
+			}
+		}
+		delete(p.issuerKeys, oldest)
+	}
+	keys := p.newKeySet(doc.JWKSURI)
+	p.issuerKeys[issuer] = &issuerKeySet{keys: keys, lastUsed: nowFunc()}
+	return keys, nil
+}
+
+// issuerKeySets returns the cached key sets of the trusted issuers.
+func (p *Provider) issuerKeySets() []*keySet {
+	p.issuerMu.Lock()
+	defer p.issuerMu.Unlock()
+	var sets []*keySet
+	for _, entry := range p.issuerKeys {
+		sets = append(sets, entry.keys)
+	}
+	return sets
+}
@@ -0,0 +1,113 @@
+package aps
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// issuerServer serves the discovery document of an issuer whose keys are
+// published by its own JWKS server.
+type issuerServer struct {
+	*httptest.Server
+	jwks        *jwksServer
+	discoveries int32
+}
+
+// newIssuerServer starts an issuer signing with key under kid.
+func newIssuerServer(kid string, key *rsa.PrivateKey) *issuerServer {
+	s := &issuerServer{jwks: newJWKSServer(map[string]*rsa.PrivateKey{kid: key})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, discoveryPath) {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&s.discoveries, 1)
+		json.NewEncoder(w).Encode(DiscoveryDocument{
+			Issuer:                s.URL,
+			AuthorizationEndpoint: s.URL + "/authorize",
+			TokenEndpoint:         s.URL + "/token",
+			UserInfoEndpoint:      s.URL + "/userinfo",
+			JWKSURI:               s.jwks.URL,
+		})
+	}))
+	return s
+}
+
+// Close shuts down the issuer and its JWKS server.
+func (s *issuerServer) Close() {
+	s.Server.Close()
+	s.jwks.Close()
+}
+
+// Discoveries returns how many times the discovery document was requested.
+func (s *issuerServer) Discoveries() int {
+	return int(atomic.LoadInt32(&s.discoveries))
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	a := newIssuerServer("a", testKey(t, 0))
+	defer a.Close()
+	b := newIssuerServer("b", testKey(t, 1))
+	defer b.Close()
+
+	p := newTestProvider()
+	p.SetTrustedIssuers(func(issuer string) bool {
+		return issuer == a.URL || issuer == b.URL
+	})
+	for _, tt := range []struct {
+		name   string
+		key    *rsa.PrivateKey
+		kid    string
+		issuer string
+		ok     bool
+	}{
+		{"first issuer", testKey(t, 0), "a", a.URL, true},
+		{"second issuer", testKey(t, 1), "b", b.URL, true},
+		{"first issuer again", testKey(t, 0), "a", a.URL, true},
+		{"key of the other issuer", testKey(t, 1), "b", a.URL, false},
+		{"forged with a known kid", testKey(t, 1), "a", a.URL, false},
+		{"untrusted issuer", testKey(t, 0), "a", "https://evil.example.com", false},
+		{"no issuer nor provider keys", testKey(t, 0), "a", "", false},
+	} {
+		claims := map[string]interface{}{"sub": "1"}
+		if tt.issuer != "" {
+			claims["iss"] = tt.issuer
+		}
+		_, err := p.verifyJWT(signTestJWT(t, tt.key, tt.kid, claims))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+	if n := a.Discoveries(); n != 1 {
+		t.Errorf("first issuer discovered %d times, want 1", n)
+	}
+	if n := b.Discoveries(); n != 1 {
+		t.Errorf("second issuer discovered %d times, want 1", n)
+	}
+}
+
+func TestTrustedIssuerMismatch(t *testing.T) {
+	a := newIssuerServer("a", testKey(t, 0))
+	defer a.Close()
+
+	// The server answers discovery under any path, so the impostor gets
+	// the document of a, whose issuer doesn't match.
+	impostor := a.URL + "/tenant"
+	p := newTestProvider()
+	p.SetTrustedIssuers(func(string) bool { return true })
+	_, err := p.verifyJWT(signTestJWT(t, testKey(t, 0), "a", map[string]interface{}{"iss": impostor}))
+	if err == nil {
+		t.Error("a token was verified with the keys of another issuer")
+	}
+	if a.Discoveries() != 1 {
+		t.Error("the impostor's discovery document was not requested")
+	}
+	if n := a.jwks.Requests(); n != 0 {
+		t.Errorf("%d JWKS requests for an unverified issuer", n)
+	}
+}
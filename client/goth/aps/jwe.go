@@ -0,0 +1,173 @@
+package aps
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1" // registers SHA-1 for RSA-OAEP
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// ErrEncryptedIDToken is returned when an encrypted id_token is received but
+// no decryption key was set with SetIDTokenDecryptionKey.
+var ErrEncryptedIDToken = errors.New("id_token is encrypted but no decryption key is set")
+
+// jweHeader is the JOSE header of a compact-serialized JWE.
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	Compression string `json:"zip"`
+}
+
+// SetIDTokenDecryptionKey sets the RSA private key used to decrypt encrypted
+// id_tokens (JWE). Tokens must use the RSA-OAEP or RSA-OAEP-256 key
+// encryption and AES GCM or AES CBC HMAC-SHA2 content encryption. The
+// decrypted token is then verified like a signed one.
+func (p *Provider) SetIDTokenDecryptionKey(key crypto.Decrypter) error {
+	if key == nil {
+		return errors.New("a decryption key should be provided")
+	}
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("unsupported decryption key type %T", key.Public())
+	}
+	p.idTokenDecrypter = key
+	return nil
+}
+
+// isJWE reports whether raw is a compact-serialized JWE, which has five
+// parts where a JWS has three.
+func isJWE(raw string) bool {
+	return strings.Count(raw, ".") == 4
+}
+
+// decryptJWE decrypts the compact-serialized JWE raw with key and returns
+// its plaintext.
+func decryptJWE(raw string, key crypto.Decrypter) ([]byte, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 5 {
+		return nil, errors.New("malformed JWE")
+	}
+	var decoded [5][]byte
+	for i, part := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("malformed JWE: %v", err)
+		}
+		decoded[i] = b
+	}
+	var header jweHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWE header: %v", err)
+	}
+
+	var oaepHash crypto.Hash
+	switch header.Algorithm {
+	case "RSA-OAEP":
+		oaepHash = crypto.SHA1
+	case "RSA-OAEP-256":
+		oaepHash = crypto.SHA256
+	default:
+		return nil, fmt.Errorf("unsupported JWE algorithm %q", header.Algorithm)
+	}
+	cek, err := key.Decrypt(rand.Reader, decoded[1], &rsa.OAEPOptions{Hash: oaepHash})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt JWE content key: %v", err)
+	}
+
+	// The additional authenticated data is the encoded header as sent.
+	aad := []byte(parts[0])
+	iv, ciphertext, tag := decoded[2], decoded[3], decoded[4]
+	var plaintext []byte
+	switch header.Encryption {
+	case "A128GCM", "A192GCM", "A256GCM":
+		plaintext, err = decryptGCM(cek, iv, ciphertext, tag, aad, header.Encryption)
+	case "A128CBC-HS256":
+		plaintext, err = decryptCBCHMAC(cek, iv, ciphertext, tag, aad, 32, sha256.New)
+	case "A192CBC-HS384":
+		plaintext, err = decryptCBCHMAC(cek, iv, ciphertext, tag, aad, 48, sha512.New384)
+	case "A256CBC-HS512":
+		plaintext, err = decryptCBCHMAC(cek, iv, ciphertext, tag, aad, 64, sha512.New)
+	default:
+		return nil, fmt.Errorf("unsupported JWE encryption %q", header.Encryption)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch header.Compression {
+	case "":
+		return plaintext, nil
+	case "DEF":
+		return io.ReadAll(flate.NewReader(bytes.NewReader(plaintext)))
+	}
+	return nil, fmt.Errorf("unsupported JWE compression %q", header.Compression)
+}
+
+// decryptGCM decrypts AES GCM content, checking the key fits enc.
+func decryptGCM(cek, iv, ciphertext, tag, aad []byte, enc string) ([]byte, error) {
+	if want := map[string]int{"A128GCM": 16, "A192GCM": 24, "A256GCM": 32}[enc]; len(cek) != want {
+		return nil, fmt.Errorf("JWE content key has %d bytes, %s needs %d", len(cek), enc, want)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(append([]byte(nil), ciphertext...), tag...), aad)
+	if err != nil {
+		return nil, errors.New("cannot decrypt JWE: authentication failed")
+	}
+	return plaintext, nil
+}
+
+// decryptCBCHMAC decrypts AES CBC content authenticated with HMAC-SHA2
+// (RFC 7518 section 5.2). The first half of the keySize byte key is the MAC
+// key, the second half the AES key.
+func decryptCBCHMAC(cek, iv, ciphertext, tag, aad []byte, keySize int, h func() hash.Hash) ([]byte, error) {
+	if len(cek) != keySize {
+		return nil, fmt.Errorf("JWE content key has %d bytes, want %d", len(cek), keySize)
+	}
+	macKey, encKey := cek[:keySize/2], cek[keySize/2:]
+
+	mac := hmac.New(h, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	binary.Write(mac, binary.BigEndian, uint64(len(aad))*8)
+	if !hmac.Equal(mac.Sum(nil)[:keySize/2], tag) {
+		return nil, errors.New("cannot decrypt JWE: authentication failed")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed JWE ciphertext")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	// Strip the PKCS #7 padding.
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("malformed JWE padding")
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
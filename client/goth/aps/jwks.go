@@ -0,0 +1,254 @@
+package aps
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jsonWebKey is a single key of a JSON Web Key Set (RFC 7517).
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+const (
+	// jwksRefreshAge is how long fetched keys are used before the key set
+	// is fetched again.
+	jwksRefreshAge = time.Hour
+	// jwksMaxStale is how long past jwksRefreshAge cached keys keep being
+	// used while the JWKS endpoint can't be reached.
+	jwksMaxStale = 24 * time.Hour
+	// defaultJWKSTimeout bounds a JWKS request unless changed with
+	// SetJWKSTimeout.
+	defaultJWKSTimeout = 10 * time.Second
+	// defaultJWKSMinInterval is the least time between two JWKS requests
+	// unless changed with SetJWKSMinRefreshInterval.
+	defaultJWKSMinInterval = 10 * time.Second
+)
+
+// keySet fetches and caches the keys published at a JWKS URL.
+type keySet struct {
+	url    string
+	client func() *http.Client
+
+	mu          sync.Mutex
+	timeout     time.Duration
+	minInterval time.Duration
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	// attemptedAt and fetchErr are the time and error of the last
+	// request, successful or not.
+	attemptedAt time.Time
+	fetchErr    error
+}
+
+// SetJWKSURL sets the JSON Web Key Set used to verify signed tokens, such as
+// JWT userinfo responses. Setting it to "" disables signature verification.
+func (p *Provider) SetJWKSURL(jwksURL string) {
+	p.jwksURL = jwksURL
+	p.jwks = nil
+	if jwksURL != "" {
+		p.jwks = p.newKeySet(jwksURL)
+	}
+}
+
+// newKeySet returns a key set for jwksURL with the provider's settings.
+func (p *Provider) newKeySet(jwksURL string) *keySet {
+	return &keySet{
+		url:         jwksURL,
+		client:      p.config.httpClient,
+		timeout:     p.jwksTimeout,
+		minInterval: p.jwksMinInterval,
+	}
+}
+
+// SetJWKSTimeout bounds how long a JWKS request may take, so an unresponsive
+// endpoint doesn't block logins. Zero restores the 10 second default.
+func (p *Provider) SetJWKSTimeout(timeout time.Duration) {
+	p.jwksTimeout = timeout
+	p.eachKeySet(func(k *keySet) { k.timeout = timeout })
+}
+
+// SetJWKSMinRefreshInterval sets the least time between two JWKS requests.
+// Tokens with an unknown key ID arriving in between don't trigger another
+// request; they fail, or use the cached keys while the endpoint is down.
+// Zero restores the 10 second default.
+func (p *Provider) SetJWKSMinRefreshInterval(interval time.Duration) {
+	p.jwksMinInterval = interval
+	p.eachKeySet(func(k *keySet) { k.minInterval = interval })
+}
+
+// eachKeySet calls update, with the key set's lock held, for the provider's
+// key set and those of the trusted issuers.
+func (p *Provider) eachKeySet(update func(*keySet)) {
+	sets := p.issuerKeySets()
+	if p.jwks != nil {
+		sets = append(sets, p.jwks)
+	}
+	for _, k := range sets {
+		k.mu.Lock()
+		update(k)
+		k.mu.Unlock()
+	}
+}
+
+// key returns the key with the given ID, fetching the key set again if the
+// ID is unknown, which is how servers roll their keys, or the cached keys
+// are due for a refresh. When the fetch fails, a cached key not older than
+// jwksMaxStale past its refresh is used instead.
+//
+// The lock is held during the request, so concurrent callers wait for its
+// result, and no request is made within the minimum interval of the last.
+func (k *keySet) key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := nowFunc()
+	age := now.Sub(k.fetchedAt)
+	key, cached := k.lookup(kid)
+	if cached && age < jwksRefreshAge {
+		return key, nil
+	}
+	minInterval := k.minInterval
+	if minInterval <= 0 {
+		minInterval = defaultJWKSMinInterval
+	}
+	fetched := false
+	if k.attemptedAt.IsZero() || now.Sub(k.attemptedAt) >= minInterval {
+		fetched = true
+		k.attemptedAt = now
+		var keys map[string]crypto.PublicKey
+		keys, k.fetchErr = k.fetch()
+		if k.fetchErr == nil {
+			k.keys, k.fetchedAt, age = keys, now, 0
+			key, cached = k.lookup(kid)
+		}
+	}
+	if cached && age < jwksRefreshAge+jwksMaxStale {
+		if fetched && k.fetchErr != nil {
+			log.Printf("aps: using cached JWKS key %q fetched %s ago: %v", kid, age.Round(time.Second), k.fetchErr)
+		}
+		return key, nil
+	}
+	if k.fetchErr != nil {
+		return nil, k.fetchErr
+	}
+	return nil, fmt.Errorf("no JWKS key with ID %q", kid)
+}
+
+// lookup returns the cached key with the given ID.
+func (k *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := k.keys[kid]; ok {
+		return key, true
+	}
+	// A token without a kid can still be verified by a single-key set.
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (k *keySet) fetch() (map[string]crypto.PublicKey, error) {
+	timeout := k.timeout
+	if timeout <= 0 {
+		timeout = defaultJWKSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := k.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("JWKS request failed: %w", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request to %s returned %s", k.url, r.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys we can't use rather than failing the whole set.
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,97 @@
+package aps
+
+import (
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJWKSTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := newTestProvider()
+	p.SetJWKSURL(srv.URL)
+	p.SetJWKSTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := p.jwks.key("k1"); err == nil {
+		t.Fatal("a key was returned by an unresponsive endpoint")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the request took %s despite the timeout", elapsed)
+	}
+}
+
+func TestJWKSMinRefreshInterval(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+	defer jwks.Close()
+
+	p := newTestProvider()
+	p.SetJWKSURL(jwks.URL)
+	p.SetJWKSMinRefreshInterval(time.Minute)
+	if _, err := p.jwks.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.jwks.key("unknown"); err == nil {
+			t.Fatal("an unknown key ID was accepted")
+		}
+	}
+	if n := jwks.Requests(); n != 1 {
+		t.Errorf("%d requests within the minimum interval, want 1", n)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := p.jwks.key("unknown"); err == nil {
+		t.Fatal("an unknown key ID was accepted")
+	}
+	if n := jwks.Requests(); n != 2 {
+		t.Errorf("%d requests after the minimum interval, want 2", n)
+	}
+	if _, err := p.jwks.key("k1"); err != nil {
+		t.Errorf("known key after a refresh: %v", err)
+	}
+	if n := jwks.Requests(); n != 2 {
+		t.Errorf("a cached key caused a request")
+	}
+}
+
+func TestJWKSStaleFallback(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer SetNowFunc(func() time.Time { return now })()
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+
+	p := newTestProvider()
+	p.SetJWKSURL(jwks.URL)
+	if _, err := p.jwks.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	jwks.Close()
+
+	// The cached key outlives the failing refreshes for a day.
+	for _, age := range []time.Duration{2 * time.Hour, 12 * time.Hour, jwksRefreshAge + jwksMaxStale - time.Minute} {
+		now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC).Add(age)
+		if _, err := p.jwks.key("k1"); err != nil {
+			t.Errorf("key fetched %s ago: %v", age, err)
+		}
+	}
+	if _, err := p.jwks.key("k2"); err == nil {
+		t.Error("an unknown key ID was accepted while the endpoint is down")
+	}
+
+	now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC).Add(jwksRefreshAge + jwksMaxStale)
+	if _, err := p.jwks.key("k1"); err == nil {
+		t.Error("the cached key was used past the stale bound")
+	}
+}
@@ -0,0 +1,134 @@
+package aps
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for JWT signature verification
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// jwtHeader is the JOSE header of a compact-serialized JWT.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// jwt is a compact-serialized JSON Web Token split into its parts.
+type jwt struct {
+	Header    jwtHeader
+	Payload   []byte
+	Signature []byte
+	// signingInput is the "header.payload" string the signature covers.
+	signingInput string
+}
+
+// parseJWT splits and decodes raw without verifying its signature.
+func parseJWT(raw string) (*jwt, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	t := &jwt{signingInput: parts[0] + "." + parts[1]}
+	if err := json.Unmarshal(header, &t.Header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	if t.Payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	if t.Signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %v", err)
+	}
+	return t, nil
+}
+
+// hash returns the hash function the JWT's algorithm signs with.
+func (t *jwt) hash() (crypto.Hash, error) {
+	if len(t.Header.Algorithm) != 5 {
+		return 0, fmt.Errorf("unsupported JWT algorithm %q", t.Header.Algorithm)
+	}
+	switch t.Header.Algorithm[2:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported JWT algorithm %q", t.Header.Algorithm)
+}
+
+// verify checks the JWT signature against key.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	h, err := t.hash()
+	if err != nil {
+		return err
+	}
+	hasher := h.New()
+	hasher.Write([]byte(t.signingInput))
+	digest := hasher.Sum(nil)
+
+	switch t.Header.Algorithm[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key is not suitable for %s", t.Header.Algorithm)
+		}
+		if t.Header.Algorithm[0] == 'P' {
+			return rsa.VerifyPSS(pub, h, digest, t.Signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, h, digest, t.Signature)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key is not suitable for %s", t.Header.Algorithm)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(t.Signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(t.Signature[:size])
+		s := new(big.Int).SetBytes(t.Signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JWT algorithm %q", t.Header.Algorithm)
+}
+
+// verifyJWT parses raw and, when the provider has a JWKS URL configured or
+// trusts the token's issuer, verifies its signature with the matching key.
+// It returns the parsed token.
+func (p *Provider) verifyJWT(raw string) (*jwt, error) {
+	t, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.keySetFor(t)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return t, nil
+	}
+	key, err := keys.key(t.Header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
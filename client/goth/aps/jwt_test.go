@@ -0,0 +1,152 @@
+package aps
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     [2]*rsa.PrivateKey
+)
+
+// testKey returns one of two RSA keys shared by the tests, generated once.
+func testKey(t *testing.T, i int) *rsa.PrivateKey {
+	testKeysOnce.Do(func() {
+		for i := range testKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				panic(err)
+			}
+			testKeys[i] = key
+		}
+	})
+	return testKeys[i]
+}
+
+// signTestJWT returns a JWT carrying claims signed by key with RS256.
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwksServer serves a JSON Web Key Set and counts the requests for it.
+type jwksServer struct {
+	*httptest.Server
+	requests int32
+}
+
+// newJWKSServer serves the public keys of keys, by key ID.
+func newJWKSServer(keys map[string]*rsa.PrivateKey) *jwksServer {
+	s := &jwksServer{}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	}))
+	return s
+}
+
+// Requests returns how many times the key set was requested.
+func (s *jwksServer) Requests() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+// newTestProvider returns a provider for the client "client" whose
+// endpoints are on localhost, for tests that make no requests to them.
+func newTestProvider() *Provider {
+	return NewCustomisedURL("client", "secret", "http://localhost/callback",
+		"http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo")
+}
+
+func TestVerifyJWT(t *testing.T) {
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+	defer jwks.Close()
+	p := newTestProvider()
+	p.SetJWKSURL(jwks.URL)
+
+	raw := signTestJWT(t, testKey(t, 0), "k1", map[string]interface{}{"sub": "1"})
+	if _, err := p.verifyJWT(raw); err != nil {
+		t.Errorf("valid JWT: %v", err)
+	}
+	parts := strings.Split(raw, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2"}`)) + "." + parts[2]
+	if _, err := p.verifyJWT(forged); err == nil {
+		t.Error("altered payload was accepted")
+	}
+	if _, err := p.verifyJWT(signTestJWT(t, testKey(t, 1), "k1", map[string]interface{}{"sub": "1"})); err == nil {
+		t.Error("JWT signed by another key was accepted")
+	}
+	if _, err := p.verifyJWT(signTestJWT(t, testKey(t, 0), "unknown", map[string]interface{}{"sub": "1"})); err == nil {
+		t.Error("JWT with an unknown key ID was accepted")
+	}
+}
+
+func TestJWTUserInfo(t *testing.T) {
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+	defer jwks.Close()
+	var body string
+	userinfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/jwt" {
+			http.Error(w, "not acceptable", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jwt")
+		fmt.Fprint(w, body)
+	}))
+	defer userinfo.Close()
+
+	p := newTestProvider()
+	p.profileURL = userinfo.URL
+	p.SetJWKSURL(jwks.URL)
+	p.SetUserInfoAccept("application/jwt")
+
+	body = signTestJWT(t, testKey(t, 0), "k1", map[string]interface{}{"sub": "42", "email": "jwt@example.com"})
+	user, err := p.FetchUserByToken(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "42" || user.Email != "jwt@example.com" {
+		t.Errorf("user = %+v", user)
+	}
+
+	body = signTestJWT(t, testKey(t, 1), "k1", map[string]interface{}{"sub": "42"})
+	if _, err := p.FetchUserByToken(context.Background(), "token"); err == nil {
+		t.Error("userinfo JWT with an invalid signature was accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package aps
+
+import (
+	"errors"
+	"net/url"
+)
+
+// SetEndSessionURL sets the provider's end_session_endpoint, used by
+// LogoutURL to build RP-initiated logout redirects.
+func (p *Provider) SetEndSessionURL(endSessionURL string) {
+	p.endSessionURL = endSessionURL
+}
+
+// SetPostLogoutRedirectURLs sets the allow-list of URLs LogoutURL accepts as
+// post_logout_redirect_uri.
+func (p *Provider) SetPostLogoutRedirectURLs(urls ...string) {
+	p.postLogoutRedirectURLs = append([]string(nil), urls...)
+}
+
+// LogoutURL returns the URL to send the user to in order to end their
+// session at the provider (OpenID Connect RP-Initiated Logout). Both
+// arguments are optional; a non-empty postLogoutRedirectURI must have been
+// registered with SetPostLogoutRedirectURLs.
+func (p *Provider) LogoutURL(idTokenHint, postLogoutRedirectURI string) (string, error) {
+	if p.endSessionURL == "" {
+		return "", errors.New("an end session URL has not been set")
+	}
+	u, err := url.Parse(p.endSessionURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	if postLogoutRedirectURI != "" {
+		if !p.postLogoutRedirectAllowed(postLogoutRedirectURI) {
+			return "", ErrRedirectURLNotAllowed
+		}
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (p *Provider) postLogoutRedirectAllowed(redirectURL string) bool {
+	for _, u := range p.postLogoutRedirectURLs {
+		if u == redirectURL {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package aps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// maxMembershipPages bounds the pages FetchUserMemberships follows.
+const maxMembershipPages = 100
+
+// Membership is a group or organization the user belongs to.
+type Membership struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// membershipsPage is a page of the memberships endpoint. Next is the URL of
+// the next page, possibly relative, empty on the last one.
+type membershipsPage struct {
+	Memberships []Membership `json:"memberships"`
+	Next        string       `json:"next"`
+}
+
+// SetMembershipsURL sets the endpoint FetchUserMemberships reads.
+func (p *Provider) SetMembershipsURL(membershipsURL string) {
+	p.membershipsURL = p.trailingSlash.normalize(membershipsURL)
+}
+
+// FetchUserMemberships returns all the memberships of the user authorized
+// by token, following the next links of the paginated memberships endpoint
+// set with SetMembershipsURL. It gives up when ctx is done, after 100
+// pages, or at a next link to another scheme or host, which would otherwise
+// receive the token. The token is refreshed if needed, as with
+// AuthenticatedRequest, at most once for all the pages.
+func (p *Provider) FetchUserMemberships(ctx context.Context, token *oauth2.Token) ([]Membership, error) {
+	if p.membershipsURL == "" {
+		return nil, errors.New("a memberships URL has not been set")
+	}
+	t := &authorizedTransport{fetcher: p.config, token: token, ctx: ctx}
+	client := &http.Client{Transport: t, CheckRedirect: sameOriginRedirect}
+	var memberships []Membership
+	next := p.membershipsURL
+	for pages := 0; next != ""; pages++ {
+		if pages == maxMembershipPages {
+			return nil, fmt.Errorf("memberships span more than %d pages", maxMembershipPages)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, err := p.fetchMembershipsPage(ctx, client, next)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, page.Memberships...)
+		if page.Next == "" {
+			break
+		}
+		current, err := url.Parse(next)
+		if err != nil {
+			return nil, err
+		}
+		link, err := url.Parse(page.Next)
+		if err != nil {
+			return nil, fmt.Errorf("invalid next link %q: %w", page.Next, err)
+		}
+		resolved := current.ResolveReference(link)
+		if !sameOrigin(resolved, current) {
+			// Don't send the token to wherever the page points.
+			return nil, fmt.Errorf("next link %q leaves %s://%s", page.Next, current.Scheme, current.Host)
+		}
+		next = resolved.String()
+	}
+	return memberships, nil
+}
+
+// fetchMembershipsPage reads the memberships page at pageURL.
+func (p *Provider) fetchMembershipsPage(ctx context.Context, client *http.Client, pageURL string) (*membershipsPage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(r.Body)
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("memberships request to %s returned %s", pageURL, r.Status)
+	}
+	limit := p.maxUserInfoSize
+	if limit <= 0 {
+		limit = defaultMaxUserInfoSize
+	}
+	page := &membershipsPage{}
+	if err := json.NewDecoder(&maxBytesReader{r: r.Body, n: limit}).Decode(page); err != nil {
+		return nil, fmt.Errorf("invalid memberships page: %w", err)
+	}
+	return page, nil
+}
@@ -0,0 +1,78 @@
+package aps_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+func TestFetchUserMemberships(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprint(w, `{"memberships":[{"id":"1","name":"one","role":"owner"}],"next":"?page=2"}`)
+		case "2":
+			fmt.Fprint(w, `{"memberships":[{"id":"2","name":"two","role":"member"}]}`)
+		}
+	})
+	defer api.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetMembershipsURL(api.URL + "/memberships")
+	got, err := p.FetchUserMemberships(context.Background(), validToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != "1" || got[1].ID != "2" || got[1].Role != "member" {
+		t.Errorf("memberships = %+v", got)
+	}
+	if auth := api.headers(); len(auth) != 2 || auth[1] != "Bearer at" {
+		t.Errorf("Authorization headers = %q", auth)
+	}
+}
+
+func TestFetchUserMembershipsForeignNextLink(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	other := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {})
+	defer other.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"memberships":[{"id":"1"}],"next":%q}`, other.URL+"/memberships?page=2")
+	})
+	defer api.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetMembershipsURL(api.URL + "/memberships")
+	_, err := p.FetchUserMemberships(context.Background(), validToken())
+	if err == nil || !strings.Contains(err.Error(), "next link") {
+		t.Errorf("err = %v, want the foreign next link rejected", err)
+	}
+	if got := other.headers(); len(got) != 0 {
+		t.Errorf("foreign next link was followed: %q", got)
+	}
+}
+
+func TestFetchUserMembershipsPageCap(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"memberships":[],"next":"?again"}`)
+	})
+	defer api.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetMembershipsURL(api.URL + "/memberships")
+	if _, err := p.FetchUserMemberships(context.Background(), validToken()); err == nil {
+		t.Fatal("endless pagination was not stopped")
+	}
+	if got := len(api.headers()); got != 100 {
+		t.Errorf("fetched %d pages, want 100", got)
+	}
+}
@@ -1,27 +1,100 @@
 package aps
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"golang.org/x/oauth2"
-	"io/ioutil"
+	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// defaultMaxIdleConnsPerHost is the number of idle connections
+	// DefaultTransport keeps per host. The OAuth endpoints are few hosts hit
+	// often, so it is well above net/http's default of 2.
+	defaultMaxIdleConnsPerHost = 32
+	// defaultIdleConnTimeout is how long an idle connection is kept open.
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
 // The default transport implementation to be used while
-// making the authorized requests.
-var DefaultTransport = http.DefaultTransport
+// making the authorized requests. It pools up to 100 idle connections,
+// 32 of them per host, closes them after 90 seconds idle and negotiates
+// HTTP/2 when the server supports it. It is shared by the providers that
+// have no transport of their own; see Provider.SetMaxIdleConnsPerHost.
+var DefaultTransport http.RoundTripper = newDefaultTransport()
+
+// newDefaultTransport returns a transport tuned like DefaultTransport.
+func newDefaultTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
 
 type tokenRespBody struct {
-	AccessToken  string        `json:"access_token"`
-	TokenType    string        `json:"token_type"`
-	RefreshToken string        `json:"refresh_token"`
-	ExpiresIn    time.Duration `json:"expires_in"`
-	IdToken      string        `json:"id_token"`
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    expiresIn `json:"expires_in"`
+	IdToken      string    `json:"id_token"`
+	Scope        string    `json:"scope"`
+}
+
+// expiresIn is the lifetime of a token in seconds. Some servers send it
+// as a numeric string, e.g. "3600", instead of a number.
+type expiresIn int64
+
+func (e *expiresIn) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		*e = 0
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = strings.TrimSpace(unquoted)
+	}
+	return e.parse(s)
+}
+
+// parse sets e from the decimal seconds s, accepting a fraction.
+func (e *expiresIn) parse(s string) error {
+	if s == "" {
+		*e = 0
+		return nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expires_in %q", s)
+	}
+	*e = expiresIn(secs)
+	return nil
+}
+
+// duration returns the lifetime as a time.Duration.
+func (e expiresIn) duration() time.Duration {
+	return time.Duration(e) * time.Second
 }
 
 // TokenFetcher refreshes or fetches a new access token from the
@@ -34,6 +107,15 @@ type TokenFetcher interface {
 	FetchToken(existing *oauth2.Token) (*oauth2.Token, error)
 }
 
+// ContextTokenFetcher is a TokenFetcher whose fetches can be cancelled
+// through a context. Transports use FetchTokenContext when the fetcher
+// implements it.
+type ContextTokenFetcher interface {
+	TokenFetcher
+	// FetchTokenContext is like FetchToken, but gives up when ctx is done.
+	FetchTokenContext(ctx context.Context, existing *oauth2.Token) (*oauth2.Token, error)
+}
+
 // Options represents options to provide OAuth 2.0 client credentials
 // and access level. A sample configuration:
 //
@@ -91,6 +173,121 @@ type Config struct {
 	authURL string
 	// TokenURL is the URL used to retrieve OAuth tokens.
 	tokenURL string
+	// onTokenRefreshed, if set, is called with every refreshed token.
+	onTokenRefreshed func(*oauth2.Token)
+	// client is used for requests to the provider; nil means a client
+	// backed by DefaultTransport. Either way requests go through a
+	// guardTransport.
+	client *http.Client
+	// rateLimitMaxWait is the longest Retry-After a rate limited token
+	// request waits for before being retried once; zero never retries.
+	rateLimitMaxWait time.Duration
+	// assertionKey, if set, signs private_key_jwt client assertions that
+	// replace the client secret at the token endpoint.
+	assertionKey   crypto.Signer
+	assertionKeyID string
+	// authStyle selects where the client credentials are sent.
+	authStyle AuthStyle
+	// resources are the RFC 8707 resource indicators sent with the
+	// authorize and token requests.
+	resources []string
+	// secretMu guards opts.ClientSecret, which SetSecret may change while
+	// token requests are in flight.
+	secretMu sync.RWMutex
+	// tracer, if set, traces the token requests.
+	tracer Tracer
+	// refreshParams are extra form parameters of refresh requests.
+	refreshParams url.Values
+	// noOpenID leaves the openid scope out of the requests.
+	noOpenID bool
+	// tlsConfig, insecureSkipVerify and maxIdleConnsPerHost are the
+	// settings client is built from.
+	tlsConfig           *tls.Config
+	insecureSkipVerify  bool
+	maxIdleConnsPerHost int
+	// transport is the config's own transport, under client; nil while
+	// the shared DefaultTransport is used.
+	transport *http.Transport
+	// allowInsecureRemote permits insecureSkipVerify for remote hosts.
+	allowInsecureRemote bool
+	// allowInsecureTransport permits plaintext http endpoints on remote
+	// hosts.
+	allowInsecureTransport bool
+	// tokenRequestHook, if set, may alter token requests before they
+	// are sent.
+	tokenRequestHook func(*http.Request) error
+	// breaker, if set, fails requests fast while the server is failing.
+	breaker *circuitBreaker
+}
+
+// ErrRateLimited is returned when the token endpoint answers with
+// 429 Too Many Requests and the request was not retried.
+type ErrRateLimited struct {
+	// RetryAfter is how long the server asked clients to wait, or zero if
+	// it did not say.
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	if e.RetryAfter == 0 {
+		return "token endpoint rate limited the request"
+	}
+	return fmt.Sprintf("token endpoint rate limited the request; retry after %s", e.RetryAfter)
+}
+
+// maxOAuthErrorSize caps the error response body read from the token
+// endpoint.
+const maxOAuthErrorSize = 64 << 10
+
+// OAuthError is an error response of the token endpoint (RFC 6749 section
+// 5.2), returned by the token exchange and refresh.
+type OAuthError struct {
+	// Code is the error code, such as invalid_grant or invalid_client.
+	Code        string
+	Description string
+	URI         string
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return "oauth2: " + e.Code
+	}
+	return fmt.Sprintf("oauth2: %s: %s", e.Code, e.Description)
+}
+
+// IsInvalidGrant reports whether err is an invalid_grant error of the token
+// endpoint: the code or refresh token is expired, revoked or was already
+// used, so the user has to log in again.
+func IsInvalidGrant(err error) bool {
+	var oauthErr *OAuthError
+	return errors.As(err, &oauthErr) && oauthErr.Code == "invalid_grant"
+}
+
+// parseOAuthError reads the error response r, returning nil if it isn't a
+// standard OAuth 2.0 error.
+func parseOAuthError(r *http.Response) *OAuthError {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxOAuthErrorSize))
+	if err != nil {
+		return nil
+	}
+	var e struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description"`
+		URI         string `json:"error_uri"`
+	}
+	if content, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); content == "application/x-www-form-urlencoded" {
+		vals, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		e.Code, e.Description, e.URI = vals.Get("error"), vals.Get("error_description"), vals.Get("error_uri")
+	} else if json.Unmarshal(body, &e) != nil {
+		return nil
+	}
+	if e.Code == "" {
+		return nil
+	}
+	return &OAuthError{Code: e.Code, Description: e.Description, URI: e.URI}
 }
 
 // Options returns options.
@@ -100,20 +297,32 @@ func (c *Config) Options() *Options {
 
 // AuthCodeURL returns a URL to OAuth 2.0 provider's consent page
 // that asks for permissions for the required scopes explicitly.
-func (c *Config) AuthCodeURL(state string) (authURL string, err error) {
+// Opts add or override query parameters of the URL.
+func (c *Config) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) (authURL string, err error) {
+	return c.authCodeURL(state, c.opts.RedirectURL, opts...)
+}
+
+func (c *Config) authCodeURL(state, redirectURL string, opts ...oauth2.AuthCodeOption) (authURL string, err error) {
 	u, err := url.Parse(c.authURL)
 	if err != nil {
 		return
 	}
-	q := url.Values{
+	v := url.Values{
 		"response_type":   {"code"},
 		"client_id":       {c.opts.ClientID},
-		"redirect_uri":    {c.opts.RedirectURL},
-		"scope":           {strings.Join(c.opts.Scopes, " ")},
+		"redirect_uri":    {redirectURL},
+		"scope":           {strings.Join(c.scopes(), " ")},
 		"state":           {state},
 		"access_type":     {c.opts.AccessType},
 		"approval_prompt": {c.opts.ApprovalPrompt},
-	}.Encode()
+	}
+	if len(c.resources) > 0 {
+		v["resource"] = c.resources
+	}
+	for k, vs := range authCodeOptionValues(opts) {
+		v[k] = vs
+	}
+	q := v.Encode()
 	if u.RawQuery == "" {
 		u.RawQuery = q
 	} else {
@@ -122,6 +331,28 @@ func (c *Config) AuthCodeURL(state string) (authURL string, err error) {
 	return u.String(), nil
 }
 
+// authCodeOptionValues returns the query parameters set by opts.
+// oauth2.AuthCodeOption only exposes its values through
+// oauth2.Config.AuthCodeURL, so the options are rendered onto an empty
+// config and the parameters that differ from a plain rendering are kept.
+func authCodeOptionValues(opts []oauth2.AuthCodeOption) url.Values {
+	if len(opts) == 0 {
+		return nil
+	}
+	render := func(opts ...oauth2.AuthCodeOption) url.Values {
+		s := (&oauth2.Config{}).AuthCodeURL("", opts...)
+		v, _ := url.ParseQuery(strings.TrimPrefix(s, "?"))
+		return v
+	}
+	base, v := render(), render(opts...)
+	for k, vs := range v {
+		if strings.Join(base[k], "\x00") == strings.Join(vs, "\x00") {
+			delete(v, k)
+		}
+	}
+	return v
+}
+
 // NewTransport creates a new authorizable transport. It doesn't
 // initialize the new transport with a token, so after creation,
 // you need to set a valid token (or an expired token with a valid
@@ -150,31 +381,81 @@ func (c *Config) NewTransportWithCode(exchangeCode string) (Transport, error) {
 // Exchange exchanges the exchange code with the OAuth 2.0 provider
 // to retrieve a new access token.
 func (c *Config) Exchange(exchangeCode string) (*oauth2.Token, error) {
+	return c.exchange(context.Background(), exchangeCode, c.opts.RedirectURL)
+}
+
+func (c *Config) exchange(ctx context.Context, exchangeCode, redirectURL string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	token := &oauth2.Token{}
-	err := c.updateToken(token, url.Values{
-		"grant_type":   {"authorization_code"},
-		"redirect_uri": {c.opts.RedirectURL},
-		"scope":        {strings.Join(c.opts.Scopes, " ")},
-		"code":         {exchangeCode},
-	})
+	v := c.exchangeValues(exchangeCode, redirectURL, opts)
+	ctx, span := c.startSpan(ctx, "aps.exchange", c.tokenURL)
+	err := c.updateToken(ctx, token, v)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(ErrTokenExchange, err)
 	}
 	return token, nil
 }
 
+// exchangeValues returns the code exchange parameters, without credentials.
+func (c *Config) exchangeValues(exchangeCode, redirectURL string, opts []oauth2.AuthCodeOption) url.Values {
+	v := url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {redirectURL},
+		"scope":        {strings.Join(c.scopes(), " ")},
+		"code":         {exchangeCode},
+	}
+	for k, vs := range authCodeOptionValues(opts) {
+		v[k] = vs
+	}
+	return v
+}
+
 // FetchToken retrieves a new access token and updates the existing token
 // with the newly fetched credentials. If existing token doesn't
-// contain a refresh token, it returns an error.
+// contain a refresh token, it returns an error. If the server rotates
+// the refresh token, the returned token carries the new one.
 func (c *Config) FetchToken(existing *oauth2.Token) (*oauth2.Token, error) {
+	return c.FetchTokenContext(context.Background(), existing)
+}
+
+// FetchTokenContext is like FetchToken, but the request to the token
+// endpoint is cancelled when ctx is done.
+func (c *Config) FetchTokenContext(ctx context.Context, existing *oauth2.Token) (*oauth2.Token, error) {
 	if existing == nil || existing.RefreshToken == "" {
 		return nil, errors.New("cannot fetch access token without refresh token.")
 	}
-	err := c.updateToken(existing, url.Values{
-		"grant_type":    {"refresh_token"},
-		"refresh_token": {existing.RefreshToken},
-	})
-	return existing, err
+	// Start from the extra parameters so the standard ones, set over them
+	// here and in updateToken, always win.
+	v := cloneValues(c.refreshParams)
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", existing.RefreshToken)
+	ctx, span := c.startSpan(ctx, "aps.refresh", c.tokenURL)
+	err := c.updateToken(ctx, existing, v)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if c.onTokenRefreshed != nil {
+		c.onTokenRefreshed(existing)
+	}
+	return existing, nil
+}
+
+// httpClient returns the client used to talk to the provider.
+func (c *Config) httpClient() *http.Client {
+	if c.client != nil {
+		return c.client
+	}
+	return &http.Client{Transport: &guardTransport{base: DefaultTransport, config: c}}
+}
+
+// closeIdleConnections closes the idle connections of the config's own
+// transport, if any. DefaultTransport is shared with other providers and
+// left alone.
+func (c *Config) closeIdleConnections() {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
 }
 
 // Checks if all required configuration fields have non-zero values.
@@ -200,26 +481,203 @@ func (c *Config) validate() error {
 	}
 	return nil
 }
-func (c *Config) updateToken(tok *oauth2.Token, v url.Values) error {
+
+// postToken posts v to the token endpoint. A 429 response is retried once
+// after its Retry-After delay when that is within rateLimitMaxWait, and
+// otherwise turned into an *ErrRateLimited.
+func (c *Config) postToken(ctx context.Context, v url.Values) (*http.Response, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	r, err := c.postTokenWithRetry(ctx, v)
+	status := 0
+	if err == nil {
+		status = r.StatusCode
+	}
+	c.breaker.done(ctx, status, err)
+	return r, err
+}
+
+// postTokenWithRetry posts v to the token endpoint, retrying once after a
+// rate limited response if allowed.
+func (c *Config) postTokenWithRetry(ctx context.Context, v url.Values) (*http.Response, error) {
+	r, err := c.doTokenRequest(ctx, v)
+	if err == nil {
+		spanFromContext(ctx).SetAttribute(attrStatusCode, r.StatusCode)
+	}
+	for retried := false; err == nil && r.StatusCode == http.StatusTooManyRequests; retried = true {
+		retryAfter := parseRetryAfter(r.Header.Get("Retry-After"))
+		drainAndClose(r.Body)
+		if retried || c.rateLimitMaxWait <= 0 || retryAfter > c.rateLimitMaxWait {
+			return nil, &ErrRateLimited{RetryAfter: retryAfter}
+		}
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r, err = c.doTokenRequest(ctx, v)
+		if err == nil {
+			spanFromContext(ctx).SetAttribute(attrStatusCode, r.StatusCode)
+		}
+	}
+	return r, err
+}
+
+// doTokenRequest sends a single token request with the form v, moving the
+// client credentials to the Authorization header when so configured.
+func (c *Config) doTokenRequest(ctx context.Context, v url.Values) (*http.Response, error) {
+	req, err := c.prepareTokenRequest(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient().Do(req)
+}
+
+// prepareTokenRequest returns the token request with the form v, as it is
+// sent: passed to the token request hook, if any.
+func (c *Config) prepareTokenRequest(ctx context.Context, v url.Values) (*http.Request, error) {
+	req, err := c.newTokenRequest(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokenRequestHook != nil {
+		if err := c.tokenRequestHook(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// newTokenRequest prepares the POST of v to the token endpoint, moving the
+// client credentials to the Authorization header if configured so.
+func (c *Config) newTokenRequest(ctx context.Context, v url.Values) (*http.Request, error) {
+	var id, secret string
+	if c.authStyle == AuthStyleInHeader && v.Get("client_secret") != "" {
+		id, secret = v.Get("client_id"), v.Get("client_secret")
+		v = cloneValues(v)
+		v.Del("client_id")
+		v.Del("client_secret")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+	}
+	return req, nil
+}
+
+// OAuth2Config returns an *oauth2.Config with the client credentials,
+// endpoints, redirect URL and scopes of c, as an escape hatch for features
+// this package doesn't wrap. It is a copy: changing it doesn't change c.
+// Settings without an oauth2.Config counterpart, such as the client
+// authentication style or resource indicators, are not carried over.
+func (c *Config) OAuth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.opts.ClientID,
+		ClientSecret: c.clientSecret(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  c.authURL,
+			TokenURL: c.tokenURL,
+		},
+		RedirectURL: c.opts.RedirectURL,
+		Scopes:      append([]string(nil), c.scopes()...),
+	}
+}
+
+// clientSecret returns the current client secret.
+func (c *Config) clientSecret() string {
+	c.secretMu.RLock()
+	defer c.secretMu.RUnlock()
+	return c.opts.ClientSecret
+}
+
+// scopes returns the scopes to request.
+func (c *Config) scopes() []string {
+	if !c.noOpenID {
+		return c.opts.Scopes
+	}
+	var scopes []string
+	for _, scope := range c.opts.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func cloneValues(v url.Values) url.Values {
+	v2 := make(url.Values, len(v))
+	for k, vs := range v {
+		v2[k] = append([]string(nil), vs...)
+	}
+	return v2
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// setClientAuth adds the client credentials and resources to the token
+// request parameters v.
+func (c *Config) setClientAuth(v url.Values) error {
 	v.Set("client_id", c.opts.ClientID)
-	v.Set("client_secret", c.opts.ClientSecret)
-	r, err := (&http.Client{Transport: DefaultTransport}).PostForm(c.tokenURL, v)
+	v.Set("client_secret", c.clientSecret())
+	if len(c.resources) > 0 {
+		v["resource"] = c.resources
+	}
+	if c.assertionKey != nil {
+		return c.setClientAssertion(v)
+	}
+	return nil
+}
+
+func (c *Config) updateToken(ctx context.Context, tok *oauth2.Token, v url.Values) error {
+	if err := c.setClientAuth(v); err != nil {
+		return err
+	}
+	r, err := c.postToken(ctx, v)
 	if err != nil {
 		return err
 	}
-	defer r.Body.Close()
+	defer drainAndClose(r.Body)
 	if r.StatusCode != 200 {
-		// TODO(jbd): Add status code or error message
+		if oauthErr := parseOAuthError(r); oauthErr != nil {
+			return oauthErr
+		}
 		return errors.New("Error during updating token.")
 	}
 	resp := &tokenRespBody{}
 	content, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	switch content {
 	case "application/x-www-form-urlencoded", "text/plain":
-		body, err := ioutil.ReadAll(r.Body)
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			return err
 		}
+		// Some servers send JSON labelled as text/plain.
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+			if err := json.Unmarshal(trimmed, &resp); err != nil {
+				return err
+			}
+			break
+		}
 		vals, err := url.ParseQuery(string(body))
 		if err != nil {
 			return err
@@ -227,15 +685,13 @@ func (c *Config) updateToken(tok *oauth2.Token, v url.Values) error {
 		resp.AccessToken = vals.Get("access_token")
 		resp.TokenType = vals.Get("token_type")
 		resp.RefreshToken = vals.Get("refresh_token")
-		resp.ExpiresIn, _ = time.ParseDuration(vals.Get("expires_in") + "s")
+		resp.ExpiresIn.parse(vals.Get("expires_in"))
 		resp.IdToken = vals.Get("id_token")
+		resp.Scope = vals.Get("scope")
 	default:
 		if err = json.NewDecoder(r.Body).Decode(&resp); err != nil {
 			return err
 		}
-		// The JSON parser treats the unitless ExpiresIn like 'ns' instead of 's' as above,
-		// so compensate here.
-		resp.ExpiresIn *= time.Second
 	}
 	tok.AccessToken = resp.AccessToken
 	tok.TokenType = resp.TokenType
@@ -246,13 +702,19 @@ func (c *Config) updateToken(tok *oauth2.Token, v url.Values) error {
 	if resp.ExpiresIn == 0 {
 		tok.Expiry = time.Time{}
 	} else {
-		tok.Expiry = time.Now().Add(resp.ExpiresIn)
+		tok.Expiry = nowFunc().Add(resp.ExpiresIn.duration())
 	}
-	/*if resp.IdToken != "" {
-		if tok.Extra == nil {
-			tok.Extra = make(map[string]string)
-		}
-		tok.Extra["id_token"] = resp.IdToken
-	}*/
+	extra := map[string]interface{}{}
+	if resp.IdToken != "" {
+		extra["id_token"] = resp.IdToken
+	}
+	// The server may grant fewer scopes than requested; when it leaves
+	// scope out, the requested scopes were granted (RFC 6749 section 5.1).
+	if resp.Scope != "" {
+		extra["scope"] = resp.Scope
+	} else if scope := v.Get("scope"); scope != "" {
+		extra["scope"] = scope
+	}
+	*tok = *tok.WithExtra(extra)
 	return nil
 }
@@ -0,0 +1,288 @@
+package aps_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+// tokenEndpoint starts a server answering token requests with status and
+// body of the given content type.
+func tokenEndpoint(status int, contentType, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+// tokenProvider returns a provider whose token endpoint is tokenURL.
+func tokenProvider(tokenURL string) *aps.Provider {
+	return aps.NewCustomisedURL(apstest.ClientID, apstest.ClientSecret, "http://localhost/callback",
+		"http://localhost/authorize", tokenURL, "http://localhost/userinfo")
+}
+
+func TestExchangeOAuthError(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	_, err := p.Exchange(context.Background(), "wrong-code")
+	var oauthErr *aps.OAuthError
+	if !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_grant" {
+		t.Fatalf("err = %v, want an invalid_grant *OAuthError", err)
+	}
+	if !aps.IsInvalidGrant(err) || !errors.Is(err, aps.ErrTokenExchange) {
+		t.Errorf("err = %v is not classified as an invalid grant of the exchange", err)
+	}
+}
+
+func TestOAuthErrorFormats(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        *aps.OAuthError
+	}{
+		{"json", "application/json", `{"error":"invalid_client","error_description":"unknown client","error_uri":"https://docs.example.com/e"}`,
+			&aps.OAuthError{Code: "invalid_client", Description: "unknown client", URI: "https://docs.example.com/e"}},
+		{"form", "application/x-www-form-urlencoded", "error=invalid_scope&error_description=no+such+scope",
+			&aps.OAuthError{Code: "invalid_scope", Description: "no such scope"}},
+		{"html", "text/html", "<h1>Bad Request</h1>", nil},
+		{"json without error", "application/json", `{"message":"bad"}`, nil},
+	} {
+		srv := tokenEndpoint(http.StatusBadRequest, tt.contentType, tt.body)
+		_, err := tokenProvider(srv.URL).Exchange(context.Background(), "code")
+		srv.Close()
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		var oauthErr *aps.OAuthError
+		found := errors.As(err, &oauthErr)
+		switch {
+		case tt.want == nil && found:
+			t.Errorf("%s: unexpected *OAuthError %+v", tt.name, oauthErr)
+		case tt.want != nil && (!found || *oauthErr != *tt.want):
+			t.Errorf("%s: err = %v, want %+v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestExpiresInFormats(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer aps.SetNowFunc(func() time.Time { return now })()
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        time.Duration
+		ok          bool
+	}{
+		{"number", "application/json", `{"access_token":"at","expires_in":3600}`, time.Hour, true},
+		{"string", "application/json", `{"access_token":"at","expires_in":"3600"}`, time.Hour, true},
+		{"padded string", "application/json", `{"access_token":"at","expires_in":" 3600 "}`, time.Hour, true},
+		{"fraction", "application/json", `{"access_token":"at","expires_in":3600.9}`, time.Hour, true},
+		{"null", "application/json", `{"access_token":"at","expires_in":null}`, 0, true},
+		{"absent", "application/json", `{"access_token":"at"}`, 0, true},
+		{"empty string", "application/json", `{"access_token":"at","expires_in":""}`, 0, true},
+		{"invalid string", "application/json", `{"access_token":"at","expires_in":"an hour"}`, 0, false},
+		{"boolean", "application/json", `{"access_token":"at","expires_in":true}`, 0, false},
+		{"form", "application/x-www-form-urlencoded", "access_token=at&expires_in=3600", time.Hour, true},
+		{"form fraction", "application/x-www-form-urlencoded", "access_token=at&expires_in=60.5", time.Minute, true},
+		{"invalid form value", "application/x-www-form-urlencoded", "access_token=at&expires_in=soon", 0, true},
+		{"JSON as text", "text/plain", `{"access_token":"at","expires_in":"60"}`, time.Minute, true},
+	} {
+		srv := tokenEndpoint(http.StatusOK, tt.contentType, tt.body)
+		token, err := tokenProvider(srv.URL).Exchange(context.Background(), "code")
+		srv.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var want time.Time
+		if tt.want != 0 {
+			want = now.Add(tt.want)
+		}
+		if !token.Expiry.Equal(want) {
+			t.Errorf("%s: Expiry = %v, want %v", tt.name, token.Expiry, want)
+		}
+	}
+}
+
+func TestResourceIndicators(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	resources := []string{"https://api.example.com", "https://files.example.com"}
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetResource(resources...)
+	session, err := p.BeginAuth("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(session.(*aps.Session).AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authURL.Query()["resource"]; !reflect.DeepEqual(got, resources) {
+		t.Errorf("authorize resource = %q, want %q", got, resources)
+	}
+	if _, err := session.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.RefreshToken(apstest.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	var grants []string
+	for _, req := range srv.Requests() {
+		if req.URL.Path != "/token" {
+			continue
+		}
+		grant := req.PostForm.Get("grant_type")
+		grants = append(grants, grant)
+		if got := req.PostForm["resource"]; !reflect.DeepEqual(got, resources) {
+			t.Errorf("%s resource = %q, want %q", grant, got, resources)
+		}
+	}
+	if want := []string{"authorization_code", "refresh_token"}; !reflect.DeepEqual(grants, want) {
+		t.Errorf("token requests %q, want %q", grants, want)
+	}
+}
+
+func TestTokenRequestHook(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetTokenRequestHook(func(req *http.Request) error {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		form.Set("nonce", "n-1")
+		encoded := form.Encode()
+		req.Body = io.NopCloser(strings.NewReader(encoded))
+		req.ContentLength = int64(len(encoded))
+		req.Header.Set("X-Request-Nonce", "n-1")
+		return nil
+	})
+	if _, err := p.Exchange(context.Background(), apstest.Code); err != nil {
+		t.Fatal(err)
+	}
+	requests := srv.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Header.Get("X-Request-Nonce") != "n-1" || req.PostForm.Get("nonce") != "n-1" {
+		t.Errorf("header %q, form %v, want the hook's nonce", req.Header.Get("X-Request-Nonce"), req.PostForm)
+	}
+	if req.PostForm.Get("code") != apstest.Code {
+		t.Errorf("form = %v, want the code kept", req.PostForm)
+	}
+
+	hookErr := errors.New("no nonce available")
+	p.SetTokenRequestHook(func(*http.Request) error { return hookErr })
+	if _, err := p.Exchange(context.Background(), apstest.Code); !errors.Is(err, hookErr) {
+		t.Errorf("err = %v, want the hook's", err)
+	}
+	if _, err := p.RefreshToken(apstest.RefreshToken); !errors.Is(err, hookErr) {
+		t.Errorf("refresh: err = %v, want the hook's", err)
+	}
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("%d requests, want none sent after the hook failed", n-1)
+	}
+}
+
+func TestSetSecret(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	srv.ClientSecret = "rotated-secret"
+	if _, err := p.Exchange(context.Background(), apstest.Code); err == nil {
+		t.Fatal("the old secret was accepted")
+	}
+	p.SetSecret("rotated-secret")
+	if _, err := p.Exchange(context.Background(), apstest.Code); err != nil {
+		t.Errorf("exchange with the rotated secret: %v", err)
+	}
+	if _, err := p.RefreshToken(apstest.RefreshToken); err != nil {
+		t.Errorf("refresh with the rotated secret: %v", err)
+	}
+}
+
+func TestSetSecretConcurrent(t *testing.T) {
+	srv := tokenEndpoint(http.StatusOK, "application/json", `{"access_token":"at","token_type":"Bearer"}`)
+	defer srv.Close()
+
+	p := tokenProvider(srv.URL)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				p.SetSecret(fmt.Sprintf("secret-%d-%d", i, j))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := p.RefreshToken("rt"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRefreshParams(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetRefreshParam("tenant", "acme")
+	p.SetRefreshParam("grant_type", "password")
+	p.SetRefreshParam("client_secret", "forged")
+	if _, err := p.RefreshToken(apstest.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&aps.Session{}).Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	requests := srv.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(requests))
+	}
+	refresh, exchange := requests[0].PostForm, requests[1].PostForm
+	if refresh.Get("tenant") != "acme" || refresh.Get("grant_type") != "refresh_token" || refresh.Get("client_secret") != apstest.ClientSecret {
+		t.Errorf("refresh form = %v, want the tenant and the standard parameters kept", refresh)
+	}
+	if exchange.Get("tenant") != "" {
+		t.Errorf("exchange form = %v, want no refresh parameters", exchange)
+	}
+}
@@ -0,0 +1,33 @@
+package aps
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Ping checks that the authorization server is reachable, e.g. for a
+// readiness probe. It requests the discovery document when the provider was
+// created with NewFromDiscovery and the authorize endpoint otherwise. Any
+// HTTP response, whatever its status, counts as reachable; only a failed
+// request, including one cut short by ctx, is an error.
+func (p *Provider) Ping(ctx context.Context) error {
+	endpoint := p.config.authURL
+	if p.discovery != nil {
+		endpoint = strings.TrimSuffix(p.discovery.Issuer, "/") + discoveryPath
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	client := *p.config.httpClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainAndClose(r.Body)
+	return nil
+}
@@ -0,0 +1,51 @@
+package aps
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+
+	"golang.org/x/oauth2"
+)
+
+// codeVerifierSize is the number of random bytes in a generated PKCE code
+// verifier; they encode to the 43 characters RFC 7636 recommends.
+const codeVerifierSize = 32
+
+// GenerateCodeVerifier returns a random PKCE (RFC 7636) code_verifier, read
+// from the source set with SetRandReader.
+func GenerateCodeVerifier() (string, error) {
+	b := make([]byte, codeVerifierSize)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallengeS256 returns the S256 code_challenge of verifier.
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// SetPKCE makes the flows started with BeginAuth and its variants use PKCE:
+// each gets a new code_verifier, kept on its Session, whose S256 challenge
+// is sent to the authorize endpoint and which Session.Authorize sends with
+// the code exchange.
+func (p *Provider) SetPKCE(enabled bool) {
+	p.pkce = enabled
+}
+
+// pkceOptions returns a new code_verifier and the authorize URL options
+// carrying its challenge.
+func pkceOptions() (verifier string, opts []oauth2.AuthCodeOption, err error) {
+	verifier, err = GenerateCodeVerifier()
+	if err != nil {
+		return "", nil, err
+	}
+	opts = []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", CodeChallengeS256(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+	return verifier, opts, nil
+}
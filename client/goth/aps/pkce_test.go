@@ -0,0 +1,82 @@
+package aps_test
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+// rfc7636Octets are the random octets of the example of RFC 7636,
+// appendix B.
+var rfc7636Octets = []byte{
+	116, 24, 223, 180, 151, 153, 224, 37, 79, 250, 96, 125, 216, 173,
+	187, 186, 22, 212, 37, 77, 105, 214, 191, 240, 91, 88, 5, 88, 83,
+	132, 141, 121,
+}
+
+const (
+	rfc7636Verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfc7636Challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestGenerateCodeVerifierDeterministic(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		restore := aps.SetRandReader(bytes.NewReader(rfc7636Octets))
+		verifier, err := aps.GenerateCodeVerifier()
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verifier != rfc7636Verifier {
+			t.Errorf("verifier = %q, want %q", verifier, rfc7636Verifier)
+		}
+	}
+	if got := aps.CodeChallengeS256(rfc7636Verifier); got != rfc7636Challenge {
+		t.Errorf("challenge = %q, want %q", got, rfc7636Challenge)
+	}
+}
+
+func TestGenerateCodeVerifierShortReader(t *testing.T) {
+	restore := aps.SetRandReader(bytes.NewReader(rfc7636Octets[:8]))
+	defer restore()
+	if _, err := aps.GenerateCodeVerifier(); err == nil {
+		t.Error("a verifier was generated from too few random bytes")
+	}
+}
+
+func TestPKCEFlow(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetPKCE(true)
+	// The state is read first, then the verifier.
+	restore := aps.SetRandReader(bytes.NewReader(append(make([]byte, 32), rfc7636Octets...)))
+	session, err := p.BeginAuth("")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session.(*aps.Session)
+	if sess.CodeVerifier != rfc7636Verifier {
+		t.Errorf("session verifier = %q, want %q", sess.CodeVerifier, rfc7636Verifier)
+	}
+	u, err := url.Parse(sess.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := u.Query(); q.Get("code_challenge") != rfc7636Challenge || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorize URL %s lacks the S256 challenge", sess.AuthURL)
+	}
+
+	if _, err := sess.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	reqs := srv.Requests()
+	if got := reqs[len(reqs)-1].Form.Get("code_verifier"); got != rfc7636Verifier {
+		t.Errorf("code_verifier sent = %q, want %q", got, rfc7636Verifier)
+	}
+}
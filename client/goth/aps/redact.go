@@ -0,0 +1,43 @@
+package aps
+
+import (
+	"crypto/subtle"
+	"net/url"
+	"strings"
+)
+
+// redactVisible is how many characters of a token redactToken keeps at
+// each end.
+const redactVisible = 4
+
+// redactToken masks the middle of a token so it can appear in errors and
+// logs. Short tokens are masked completely, as their ends would give away
+// too much of them.
+func redactToken(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 4*redactVisible {
+		return "****"
+	}
+	return s[:redactVisible] + "****" + s[len(s)-redactVisible:]
+}
+
+// redactURLError masks token in the URL of err when it is the *url.Error of
+// a request that carried token in its query, such as the userinfo request,
+// so that the error can be returned and logged.
+func redactURLError(err error, token string) error {
+	uerr, ok := err.(*url.Error)
+	if !ok || token == "" {
+		return err
+	}
+	masked := *uerr
+	masked.URL = strings.ReplaceAll(uerr.URL, url.QueryEscape(token), redactToken(token))
+	return &masked
+}
+
+// EqualTokens reports whether two tokens, states or codes are equal, taking
+// the same time whatever the position of the first difference.
+func EqualTokens(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
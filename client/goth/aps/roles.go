@@ -0,0 +1,76 @@
+package aps
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/markbates/goth"
+)
+
+// roleClaims are the claims merged into RawData by setRoleClaims.
+var roleClaims = []string{"roles", "groups"}
+
+// setRoleClaims sets RawData["roles"] and RawData["groups"] of user to the
+// []string union of the claims of the same name in the userinfo response
+// raw, the session's id_token and its access token, when it is a JWT.
+// Claims may be arrays of strings or space-delimited strings. Tokens that
+// fail verification are left out. Without a JWKS URL or a trusted issuer
+// the access token's signature cannot be checked, and its claims are taken
+// from its unverified payload.
+func (p *Provider) setRoleClaims(sess *Session, user *goth.User, raw json.RawMessage) {
+	sources := []json.RawMessage{raw}
+	if sess.IDToken != "" {
+		if _, payload, err := p.verifyIDTokenPayload(sess.IDToken); err == nil {
+			sources = append(sources, payload)
+		}
+	}
+	if sess.AccessToken != "" {
+		if _, err := parseJWT(sess.AccessToken); err == nil {
+			if t, err := p.verifyJWT(sess.AccessToken); err == nil {
+				sources = append(sources, t.Payload)
+			}
+		}
+	}
+
+	for _, claim := range roleClaims {
+		var values []string
+		seen := map[string]bool{}
+		for _, source := range sources {
+			var claims map[string]interface{}
+			if json.Unmarshal(source, &claims) != nil {
+				continue
+			}
+			for _, v := range claimStrings(claims[claim]) {
+				if !seen[v] {
+					seen[v] = true
+					values = append(values, v)
+				}
+			}
+		}
+		if values == nil {
+			continue
+		}
+		if user.RawData == nil {
+			user.RawData = map[string]interface{}{}
+		}
+		user.RawData[claim] = values
+	}
+}
+
+// claimStrings returns the strings of a claim that is an array of strings
+// or a space-delimited string.
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		var values []string
+		for _, v := range claim {
+			if s, ok := v.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
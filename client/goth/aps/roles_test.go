@@ -0,0 +1,109 @@
+package aps
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/markbates/goth"
+)
+
+func TestClaimStrings(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		claim string
+		want  []string
+	}{
+		{"array", `["admin","dev"]`, []string{"admin", "dev"}},
+		{"space-delimited string", `"admin  dev"`, []string{"admin", "dev"}},
+		{"single string", `"admin"`, []string{"admin"}},
+		{"array with other values", `["admin",42,"",null,"dev"]`, []string{"admin", "dev"}},
+		{"empty string", `""`, nil},
+		{"number", `42`, nil},
+		{"object", `{"admin":true}`, nil},
+		{"missing", `null`, nil},
+	} {
+		var claim interface{}
+		if err := json.Unmarshal([]byte(tt.claim), &claim); err != nil {
+			t.Fatal(err)
+		}
+		if got := claimStrings(claim); len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: claimStrings(%s) = %q, want %q", tt.name, tt.claim, got, tt.want)
+		}
+	}
+}
+
+func TestSetRoleClaims(t *testing.T) {
+	jwks := newJWKSServer(map[string]*rsa.PrivateKey{"k1": testKey(t, 0)})
+	defer jwks.Close()
+	idToken := func(key *rsa.PrivateKey, claims map[string]interface{}) string {
+		claims["aud"] = "client"
+		return signTestJWT(t, key, "k1", claims)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		jwks        bool
+		userInfo    string
+		idToken     string
+		accessToken string
+		roles       []string
+		groups      []string
+	}{
+		{
+			name:     "userinfo only",
+			userInfo: `{"roles":["admin"],"groups":"staff dev"}`,
+			roles:    []string{"admin"},
+			groups:   []string{"staff", "dev"},
+		},
+		{
+			name:        "all sources merged",
+			jwks:        true,
+			userInfo:    `{"roles":"admin"}`,
+			idToken:     idToken(testKey(t, 0), map[string]interface{}{"roles": []string{"admin", "dev"}, "groups": "staff"}),
+			accessToken: signTestJWT(t, testKey(t, 0), "k1", map[string]interface{}{"roles": "ops", "groups": []string{"staff", "oncall"}}),
+			roles:       []string{"admin", "dev", "ops"},
+			groups:      []string{"staff", "oncall"},
+		},
+		{
+			name:        "opaque access token",
+			jwks:        true,
+			userInfo:    `{}`,
+			idToken:     idToken(testKey(t, 0), map[string]interface{}{"groups": []string{"staff"}}),
+			accessToken: "opaque",
+			groups:      []string{"staff"},
+		},
+		{
+			name:        "tokens failing verification",
+			jwks:        true,
+			userInfo:    `{"roles":["admin"]}`,
+			idToken:     idToken(testKey(t, 1), map[string]interface{}{"roles": "root"}),
+			accessToken: signTestJWT(t, testKey(t, 1), "k1", map[string]interface{}{"roles": "root"}),
+			roles:       []string{"admin"},
+		},
+		{
+			// Without a JWKS the access token's payload is not verified.
+			name:        "unverified access token",
+			userInfo:    `{}`,
+			accessToken: signTestJWT(t, testKey(t, 1), "k1", map[string]interface{}{"roles": "root"}),
+			roles:       []string{"root"},
+		},
+		{
+			name:     "no roles",
+			userInfo: `{"name":"user"}`,
+		},
+	} {
+		p := newTestProvider()
+		if tt.jwks {
+			p.SetJWKSURL(jwks.URL)
+		}
+		user := goth.User{}
+		p.setRoleClaims(&Session{IDToken: tt.idToken, AccessToken: tt.accessToken}, &user, json.RawMessage(tt.userInfo))
+		roles, _ := user.RawData["roles"].([]string)
+		groups, _ := user.RawData["groups"].([]string)
+		if !reflect.DeepEqual(roles, tt.roles) || !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%s: roles %q, groups %q, want %q, %q", tt.name, roles, groups, tt.roles, tt.groups)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package aps
+
+import (
+	"errors"
+	"strings"
+)
+
+// UnsupportedScopeError is returned when a flow is started with scopes the
+// server doesn't list in its scopes_supported metadata and ValidateScopes
+// is enabled.
+type UnsupportedScopeError struct {
+	Scopes []string
+}
+
+func (e *UnsupportedScopeError) Error() string {
+	return "scopes not supported by the server: " + strings.Join(e.Scopes, " ")
+}
+
+// IsUnsupportedScope reports whether err is an *UnsupportedScopeError.
+func IsUnsupportedScope(err error) bool {
+	var scopeErr *UnsupportedScopeError
+	return errors.As(err, &scopeErr)
+}
+
+// ValidateScopes makes BeginAuth and its variants fail with an
+// *UnsupportedScopeError, before any request, when a requested scope is
+// missing from the scopes_supported of the discovery document. It has no
+// effect for providers not created with NewFromDiscovery or servers that
+// don't publish scopes_supported, which need not list every scope.
+func (p *Provider) ValidateScopes(validate bool) {
+	p.validateScopes = validate
+}
+
+// checkScopesSupported returns an *UnsupportedScopeError for the scopes the
+// server doesn't support, if ValidateScopes is enabled.
+func (p *Provider) checkScopesSupported(scopes []string) error {
+	if !p.validateScopes || p.discovery == nil || len(p.discovery.ScopesSupported) == 0 {
+		return nil
+	}
+	supported := make(map[string]bool, len(p.discovery.ScopesSupported))
+	for _, scope := range p.discovery.ScopesSupported {
+		supported[p.normalizeScope(scope)] = true
+	}
+	var unsupported []string
+	for _, scope := range scopes {
+		if !supported[p.normalizeScope(scope)] {
+			unsupported = append(unsupported, scope)
+		}
+	}
+	if unsupported != nil {
+		return &UnsupportedScopeError{Scopes: unsupported}
+	}
+	return nil
+}
+
+// SetScopeNormalizer sets a function mapping scopes to the form they are
+// compared in, e.g. stripping a namespace prefix the server leaves out of
+// the granted scopes. It only affects comparisons such as MissingScopes;
+// sessions and RawData keep the scopes as sent by the server.
+func (p *Provider) SetScopeNormalizer(normalize func(string) string) {
+	p.scopeNormalizer = normalize
+}
+
+// MissingScopes returns the scopes requested for sess, its own if it was
+// started with BeginAuthWithScopes and the provider's otherwise, that the
+// server did not grant. It returns nil when the server granted them all or
+// the session doesn't know what was granted.
+func (p *Provider) MissingScopes(sess *Session) []string {
+	if sess.GrantedScopes == nil {
+		return nil
+	}
+	requested := sess.Scopes
+	if len(requested) == 0 {
+		requested = p.config.scopes()
+	}
+	granted := make(map[string]bool, len(sess.GrantedScopes))
+	for _, scope := range sess.GrantedScopes {
+		granted[p.normalizeScope(scope)] = true
+	}
+	var missing []string
+	for _, scope := range requested {
+		if !granted[p.normalizeScope(scope)] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+func (p *Provider) normalizeScope(scope string) string {
+	if p.scopeNormalizer == nil {
+		return scope
+	}
+	return p.scopeNormalizer(scope)
+}
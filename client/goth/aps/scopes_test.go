@@ -0,0 +1,79 @@
+package aps_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+)
+
+func TestMissingScopes(t *testing.T) {
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo",
+		"openid", "https://api.example.com/orders.read")
+	for _, tt := range []struct {
+		name      string
+		normalize func(string) string
+		sess      *aps.Session
+		want      []string
+	}{
+		{"all granted", nil, &aps.Session{GrantedScopes: []string{"https://api.example.com/orders.read", "openid"}}, nil},
+		{"unknown grant", nil, &aps.Session{}, nil},
+		{"prefix left out", nil, &aps.Session{GrantedScopes: []string{"openid", "orders.read"}}, []string{"https://api.example.com/orders.read"}},
+		{"prefix stripped", stripPrefix, &aps.Session{GrantedScopes: []string{"openid", "orders.read"}}, nil},
+		{"narrowed", stripPrefix, &aps.Session{GrantedScopes: []string{"orders.read"}}, []string{"openid"}},
+		{"step-up scopes", nil, &aps.Session{Scopes: []string{"orders.write"}, GrantedScopes: []string{"openid"}}, []string{"orders.write"}},
+	} {
+		p.SetScopeNormalizer(tt.normalize)
+		if got := p.MissingScopes(tt.sess); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: MissingScopes = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// stripPrefix strips the API prefix of a scope.
+func stripPrefix(scope string) string {
+	return strings.TrimPrefix(scope, "https://api.example.com/")
+}
+
+func TestValidateScopes(t *testing.T) {
+	srv := discoveryServer(aps.DiscoveryDocument{ScopesSupported: []string{"openid", "profile", "email", "orders.read"}})
+	defer srv.Close()
+	p, err := aps.NewFromDiscovery(srv.URL, "id", "secret", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.BeginAuthWithScopes("state", "openid", "orders.write"); err != nil {
+		t.Errorf("validation disabled: %v", err)
+	}
+	p.ValidateScopes(true)
+	if _, err := p.BeginAuth("state"); err != nil {
+		t.Errorf("supported scopes: %v", err)
+	}
+	_, err = p.BeginAuthWithScopes("state", "openid", "orders.write", "admin")
+	var scopeErr *aps.UnsupportedScopeError
+	if !errors.As(err, &scopeErr) || !reflect.DeepEqual(scopeErr.Scopes, []string{"orders.write", "admin"}) {
+		t.Errorf("err = %v, want the unsupported scopes", err)
+	}
+	if !aps.IsUnsupportedScope(err) {
+		t.Errorf("IsUnsupportedScope(%v) = false", err)
+	}
+	p.SetScopeNormalizer(stripPrefix)
+	if _, err := p.BeginAuthWithScopes("state", "https://api.example.com/orders.read"); err != nil {
+		t.Errorf("normalized scope: %v", err)
+	}
+
+	// Servers not publishing scopes_supported aren't checked.
+	bare := discoveryServer(aps.DiscoveryDocument{})
+	defer bare.Close()
+	p, err = aps.NewFromDiscovery(bare.URL, "id", "secret", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ValidateScopes(true)
+	if _, err := p.BeginAuthWithScopes("state", "admin"); err != nil {
+		t.Errorf("no scopes_supported: %v", err)
+	}
+}
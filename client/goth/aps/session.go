@@ -1,19 +1,34 @@
 package aps
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
 	"strings"
 	"time"
 )
 
 // Session stores data during the auth process with APS.
+// The JSON names are pinned to the ones sessions have always been marshalled
+// with, so stored sessions keep loading if fields are renamed.
 type Session struct {
-	AuthURL      string
-	AccessToken  string
-	RefreshToken string
-	ExpiresAt    time.Time
+	AuthURL      string    `json:"AuthURL"`
+	RedirectURL  string    `json:"RedirectURL"`
+	AccessToken  string    `json:"AccessToken"`
+	RefreshToken string    `json:"RefreshToken"`
+	ExpiresAt    time.Time `json:"ExpiresAt"`
+	IDToken      string    `json:"IDToken"`
+	// Scopes are the scopes requested for this flow instead of the
+	// provider's, set by BeginAuthWithScopes.
+	Scopes []string `json:"Scopes,omitempty"`
+	// GrantedScopes are the scopes the server granted, which may be fewer
+	// than the provider requested.
+	GrantedScopes []string `json:"GrantedScopes"`
+	// CodeVerifier is the PKCE code_verifier of the flow, set by
+	// BeginAuth when SetPKCE is enabled.
+	CodeVerifier string `json:"CodeVerifier,omitempty"`
 }
 
 // GetAuthURL will return the URL set by calling the `BeginAuth` function on the APS provider.
@@ -27,7 +42,7 @@ func (s Session) GetAuthURL() (string, error) {
 // Authorize - Please fill the code
 func (s *Session) Authorize(provider goth.Provider, params goth.Params) (string, error) {
 	p := provider.(*Provider)
-	token, err := p.config.Exchange(params.Get("code"))
+	token, err := p.config.exchange(context.Background(), params.Get("code"), s.exchangeRedirectURL(p), s.exchangeOptions()...)
 	if err != nil {
 		return "", err
 	}
@@ -35,11 +50,97 @@ func (s *Session) Authorize(provider goth.Provider, params goth.Params) (string,
 	if !token.Valid() {
 		return "", errors.New("Invalid token received from provider")
 	}
+	if err := s.setToken(p, token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, err
+}
+
+// exchangeRedirectURL returns the redirect_uri the flow of the session was
+// started with, which its code exchange must send again.
+func (s *Session) exchangeRedirectURL(p *Provider) string {
+	if s.RedirectURL == "" {
+		return p.config.opts.RedirectURL
+	}
+	return s.RedirectURL
+}
+
+// exchangeOptions returns the options of the code exchange of the session:
+// the scopes and PKCE code_verifier of its flow.
+func (s *Session) exchangeOptions() []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	if len(s.Scopes) > 0 {
+		opts = append(opts, scopeOption(s.Scopes))
+	}
+	if s.CodeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", s.CodeVerifier))
+	}
+	return opts
+}
+
+// SessionFromRefreshToken creates an authorized session from a refresh token
+// obtained elsewhere, e.g. migrated from another system, without running the
+// authorization flow: the token is refreshed right away to get an access
+// token, so an invalid refresh token is reported here.
+func (p *Provider) SessionFromRefreshToken(ctx context.Context, refreshToken string) (*Session, error) {
+	token, err := p.config.FetchTokenContext(ctx, &oauth2.Token{RefreshToken: refreshToken})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid() {
+		return nil, errors.New("Invalid token received from provider")
+	}
+	s := &Session{RedirectURL: p.config.opts.RedirectURL}
+	if err := s.setToken(p, token); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setToken stores token on the session once its id_token, if any, has been
+// verified.
+func (s *Session) setToken(p *Provider, token *oauth2.Token) error {
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken != "" {
+		claims, err := p.verifyIDToken(idToken)
+		if err != nil {
+			return err
+		}
+		if err := claims.verifyAccessTokenHash(token.AccessToken); err != nil {
+			return err
+		}
+	}
 
 	s.AccessToken = token.AccessToken
 	s.RefreshToken = token.RefreshToken
 	s.ExpiresAt = token.Expiry
-	return token.AccessToken, err
+	s.IDToken = idToken
+	if scope, ok := token.Extra("scope").(string); ok {
+		s.GrantedScopes = strings.Fields(scope)
+	}
+	return nil
+}
+
+// HasRefreshToken reports whether the session holds a refresh token.
+func (s Session) HasRefreshToken() bool {
+	return s.RefreshToken != ""
+}
+
+// GetAccessToken returns the access token of the session, empty until
+// Authorize succeeds.
+func (s Session) GetAccessToken() string {
+	return s.AccessToken
+}
+
+// GetRefreshToken returns the refresh token of the session, if any.
+func (s Session) GetRefreshToken() string {
+	return s.RefreshToken
+}
+
+// GetExpiry returns when the access token expires, the zero time if the
+// server didn't say.
+func (s Session) GetExpiry() time.Time {
+	return s.ExpiresAt
 }
 
 // Marshal the session into a string
@@ -48,7 +149,13 @@ func (s Session) Marshal() string {
 	return string(b)
 }
 
+// String describes the session for logs and debugging. Unlike Marshal it
+// never includes the raw tokens, only their redacted form.
 func (s Session) String() string {
+	s.AccessToken = redactToken(s.AccessToken)
+	s.RefreshToken = redactToken(s.RefreshToken)
+	s.IDToken = redactToken(s.IDToken)
+	s.CodeVerifier = redactToken(s.CodeVerifier)
 	return s.Marshal()
 }
 
@@ -0,0 +1,155 @@
+package aps_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	for _, tt := range []struct {
+		name  string
+		scope string
+		want  []string
+	}{
+		{"narrowed", `,"scope":"profile email"`, []string{"profile", "email"}},
+		{"omitted", "", []string{"profile", "email", "openid"}},
+	} {
+		token := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer"%s}`, apstest.AccessToken, tt.scope)
+		}))
+		p := aps.NewCustomisedURL(apstest.ClientID, apstest.ClientSecret, "http://localhost/callback",
+			srv.AuthURL(), token.URL, srv.ProfileURL())
+		session := &aps.Session{}
+		_, err := session.Authorize(p, url.Values{"code": {apstest.Code}})
+		token.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(session.GrantedScopes, tt.want) {
+			t.Errorf("%s: granted scopes = %q, want %q", tt.name, session.GrantedScopes, tt.want)
+		}
+		user, err := p.FetchUser(session)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, _ := user.RawData["scopes"].([]string); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: user scopes = %v, want %q", tt.name, user.RawData["scopes"], tt.want)
+		}
+	}
+}
+
+// discoveryServer serves doc as a discovery document, with the issuer and
+// endpoints set to the server's.
+func discoveryServer(doc aps.DiscoveryDocument) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc := doc
+		doc.Issuer = srv.URL
+		doc.AuthorizationEndpoint = srv.URL + "/authorize"
+		doc.TokenEndpoint = srv.URL + "/token"
+		doc.UserInfoEndpoint = srv.URL + "/userinfo"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(doc)
+	}))
+	return srv
+}
+
+func TestRefreshTokenAvailable(t *testing.T) {
+	p := aps.NewCustomisedURL("id", "secret", "http://localhost/callback", "http://localhost/authorize", "http://localhost/token", "http://localhost/userinfo")
+	if !p.RefreshTokenAvailable() {
+		t.Error("RefreshTokenAvailable = false without discovery")
+	}
+	for _, tt := range []struct {
+		name       string
+		grantTypes []string
+		want       bool
+	}{
+		{"grant types not listed", nil, true},
+		{"refresh_token grant", []string{"authorization_code", "refresh_token"}, true},
+		{"no refresh_token grant", []string{"authorization_code", "client_credentials"}, false},
+	} {
+		srv := discoveryServer(aps.DiscoveryDocument{GrantTypesSupported: tt.grantTypes})
+		p, err := aps.NewFromDiscovery(srv.URL, "id", "secret", "http://localhost/callback")
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := p.RefreshTokenAvailable(); got != tt.want {
+			t.Errorf("%s: RefreshTokenAvailable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHasRefreshToken(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	p := srv.Provider("http://localhost/callback")
+
+	session := &aps.Session{}
+	if session.HasRefreshToken() {
+		t.Error("HasRefreshToken = true before the exchange")
+	}
+	if _, err := session.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	if !session.HasRefreshToken() {
+		t.Error("HasRefreshToken = false after receiving a refresh token")
+	}
+
+	srv.RefreshToken = ""
+	session = &aps.Session{}
+	if _, err := session.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	if session.HasRefreshToken() {
+		t.Error("HasRefreshToken = true without a refresh token in the response")
+	}
+}
+
+func TestBeginAuthWithScopes(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	p.SetPrompt("consent")
+	session, err := p.BeginAuthWithScopes("state", "orders:write", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session.(*aps.Session)
+	authURL, err := url.Parse(sess.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := authURL.Query(); q.Get("scope") != "orders:write openid" || q.Get("prompt") != "consent" {
+		t.Errorf("authorize query = %v, want the step-up scopes with consent", q)
+	}
+
+	// The session carries the scopes to the exchange, even restored.
+	restored, err := p.UnmarshalSession(sess.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Authorize(p, url.Values{"code": {apstest.Code}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range srv.Requests() {
+		if req.URL.Path == "/token" && req.PostForm.Get("scope") != "orders:write openid" {
+			t.Errorf("token request scope = %q, want the step-up scopes", req.PostForm.Get("scope"))
+		}
+	}
+	if scope := authQuery(t, p).Get("scope"); scope != "profile email openid" {
+		t.Errorf("next flow scope = %q, want the provider's scopes", scope)
+	}
+}
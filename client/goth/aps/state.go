@@ -0,0 +1,137 @@
+package aps
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// stateSize is the number of random bytes in a generated state.
+const stateSize = 32
+
+// randReader is the source of the random states, PKCE code verifiers and
+// client assertion IDs.
+var randReader io.Reader = rand.Reader
+
+// SetRandReader replaces the random source used to generate states, PKCE
+// code verifiers and client assertions, e.g. with a FIPS validated source,
+// or with a deterministic one in tests. It returns a function restoring the
+// previous source; nil restores crypto/rand.Reader. A replacement must be
+// cryptographically secure outside of tests. It is not safe to call while
+// providers are in use.
+func SetRandReader(r io.Reader) (restore func()) {
+	prev := randReader
+	if r == nil {
+		r = rand.Reader
+	}
+	randReader = r
+	return func() { randReader = prev }
+}
+
+// GenerateState returns a random, URL-safe state value suitable for CSRF
+// protection of the authorization flow.
+func GenerateState() (string, error) {
+	b := make([]byte, stateSize)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetStateEncoder replaces the generator the provider uses for state values,
+// for apps that want a different length or encoding, or to embed data in
+// the state. State is treated as opaque everywhere else in the provider.
+func (p *Provider) SetStateEncoder(encoder func() (string, error)) {
+	p.stateEncoder = encoder
+}
+
+// GenerateState returns a new state value from the provider's state
+// encoder, or from the package GenerateState when none is set.
+func (p *Provider) GenerateState() (string, error) {
+	if p.stateEncoder != nil {
+		return p.stateEncoder()
+	}
+	return GenerateState()
+}
+
+// ErrInvalidState is returned by DecodeState for a state that was not
+// produced by EncodeState with the same secret or was altered.
+var ErrInvalidState = errors.New("state is malformed or its signature is invalid")
+
+// signedState is what EncodeState signs. The nonce keeps states
+// unpredictable, as CSRF protection requires, whatever the payload.
+type signedState struct {
+	Nonce   string            `json:"n"`
+	Payload map[string]string `json:"p,omitempty"`
+}
+
+// SetStateSecret sets the key EncodeState and DecodeState sign states with.
+// It should be at least 32 random bytes and shared by all instances of the
+// app handling callbacks.
+func (p *Provider) SetStateSecret(secret []byte) {
+	p.stateSecret = append([]byte(nil), secret...)
+}
+
+// EncodeState returns a state carrying payload, such as the path to return
+// to after login, signed with the secret set by SetStateSecret so that
+// DecodeState detects tampering. The payload is encoded, not encrypted: it
+// must not hold secrets. Pass the state to BeginAuth.
+func (p *Provider) EncodeState(payload map[string]string) (string, error) {
+	if len(p.stateSecret) == 0 {
+		return "", errors.New("a state secret should be set with SetStateSecret")
+	}
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(randReader, nonce); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(signedState{
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+		Payload: payload,
+	})
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(b)
+	return body + "." + base64.RawURLEncoding.EncodeToString(p.signState(body)), nil
+}
+
+// DecodeState verifies a state produced by EncodeState and returns its
+// payload, or ErrInvalidState.
+func (p *Provider) DecodeState(state string) (map[string]string, error) {
+	if len(p.stateSecret) == 0 {
+		return nil, errors.New("a state secret should be set with SetStateSecret")
+	}
+	i := strings.LastIndexByte(state, '.')
+	if i < 0 {
+		return nil, ErrInvalidState
+	}
+	body := state[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(state[i+1:])
+	if err != nil || !hmac.Equal(sig, p.signState(body)) {
+		return nil, ErrInvalidState
+	}
+	b, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	var s signedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, ErrInvalidState
+	}
+	if s.Payload == nil {
+		s.Payload = map[string]string{}
+	}
+	return s.Payload, nil
+}
+
+// signState returns the HMAC-SHA256 of an encoded state body.
+func (p *Provider) signState(body string) []byte {
+	mac := hmac.New(sha256.New, p.stateSecret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
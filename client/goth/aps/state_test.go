@@ -0,0 +1,86 @@
+package aps_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+)
+
+func TestEncodeState(t *testing.T) {
+	p := aps.New("id", "secret", "http://localhost/callback")
+	p.SetStateSecret([]byte("0123456789abcdef0123456789abcdef"))
+	payload := map[string]string{"return_to": "/orders?id=1&view=full"}
+
+	state, err := p.EncodeState(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(state, "?&=/+") {
+		t.Errorf("state %q is not URL safe", state)
+	}
+	got, err := p.DecodeState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payload) {
+		t.Errorf("payload = %v, want %v", got, payload)
+	}
+
+	other, err := p.EncodeState(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == state {
+		t.Error("states with the same payload are equal")
+	}
+}
+
+func TestDecodeStateTampered(t *testing.T) {
+	p := aps.New("id", "secret", "http://localhost/callback")
+	p.SetStateSecret([]byte("0123456789abcdef0123456789abcdef"))
+	state, err := p.EncodeState(map[string]string{"return_to": "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := p.EncodeState(map[string]string{"return_to": "https://evil.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig := state[:strings.LastIndexByte(state, '.')], state[strings.LastIndexByte(state, '.'):]
+	forgedBody := forged[:strings.LastIndexByte(forged, '.')]
+
+	other := aps.New("id", "secret", "http://localhost/callback")
+	other.SetStateSecret([]byte("another secret of thirty-two bytes"))
+	for name, decode := range map[string]func() (map[string]string, error){
+		"swapped body":   func() (map[string]string, error) { return p.DecodeState(forgedBody + sig) },
+		"no signature":   func() (map[string]string, error) { return p.DecodeState(body) },
+		"garbage":        func() (map[string]string, error) { return p.DecodeState("not.a.state") },
+		"another secret": func() (map[string]string, error) { return other.DecodeState(state) },
+	} {
+		if _, err := decode(); err != aps.ErrInvalidState {
+			t.Errorf("%s: err = %v, want ErrInvalidState", name, err)
+		}
+	}
+}
+
+func TestEncodeStateWithoutSecret(t *testing.T) {
+	p := aps.New("id", "secret", "http://localhost/callback")
+	if _, err := p.EncodeState(nil); err == nil {
+		t.Error("a state was encoded without a secret")
+	}
+}
+
+func TestGenerateStateDeterministic(t *testing.T) {
+	restore := aps.SetRandReader(bytes.NewReader(make([]byte, 32)))
+	state, err := aps.GenerateState()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("A", 43); state != want {
+		t.Errorf("state = %q, want %q", state, want)
+	}
+}
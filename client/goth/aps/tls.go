@@ -0,0 +1,182 @@
+package aps
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// InsecureSkipVerify disables TLS certificate verification on the requests
+// the provider makes, to the token, userinfo, JWKS and other endpoints. It
+// exists for development servers with self-signed certificates and must
+// never be used in production: a warning is logged every time it is
+// enabled, and unless AllowInsecureRemote(true) was called first it is
+// refused when an https endpoint points at a non-loopback host. The check is
+// repeated when endpoints change and on every request, so endpoints set or
+// discovered later are covered too.
+func (p *Provider) InsecureSkipVerify(skip bool) error {
+	if !skip {
+		p.config.insecureSkipVerify = false
+		p.config.updateClient()
+		return nil
+	}
+	if err := p.config.checkRemoteHTTPS(p.config.tokenURL, p.profileURL, p.jwksURL, p.membershipsURL); err != nil {
+		return err
+	}
+	log.Printf("aps: WARNING: TLS certificate verification is DISABLED for provider %q; never do this in production", p.Name())
+	p.config.insecureSkipVerify = true
+	p.config.updateClient()
+	return nil
+}
+
+// checkSkipVerify checks endpoints with checkRemoteHTTPS while
+// certificates are not verified.
+func (c *Config) checkSkipVerify(endpoints ...string) error {
+	if !c.insecureSkipVerify {
+		return nil
+	}
+	return c.checkRemoteHTTPS(endpoints...)
+}
+
+// checkRemoteHTTPS returns an error for the first of endpoints that is an
+// https URL on a remote host, unless AllowInsecureRemote was called.
+func (c *Config) checkRemoteHTTPS(endpoints ...string) error {
+	if c.allowInsecureRemote {
+		return nil
+	}
+	for _, endpoint := range endpoints {
+		if remote, err := isRemoteHTTPS(endpoint); err != nil || remote {
+			return fmt.Errorf("refusing to skip TLS verification for remote endpoint %s", endpoint)
+		}
+	}
+	return nil
+}
+
+// SetClientCertificate makes the provider present cert to servers asking
+// for a client certificate (mutual TLS) on the token and userinfo requests,
+// as well as on the requests of transports using its Config.
+func (p *Provider) SetClientCertificate(cert tls.Certificate) {
+	cfg := &tls.Config{}
+	if p.config.tlsConfig != nil {
+		cfg = p.config.tlsConfig.Clone()
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	p.config.tlsConfig = cfg
+	p.config.updateClient()
+}
+
+// SetTLSConfig sets the TLS configuration of the token, userinfo and
+// transport requests, e.g. for custom root CAs or client certificates.
+// Nil restores the default. InsecureSkipVerify(true) still takes precedence
+// over its certificate verification settings.
+func (p *Provider) SetTLSConfig(cfg *tls.Config) {
+	p.config.tlsConfig = nil
+	if cfg != nil {
+		p.config.tlsConfig = cfg.Clone()
+	}
+	p.config.updateClient()
+}
+
+// SetMaxIdleConnsPerHost sets how many idle connections the provider keeps
+// for each host. Like the TLS settings, it gives the provider a transport
+// of its own, tuned like DefaultTransport otherwise, so other providers are
+// not affected. Zero restores the default.
+func (p *Provider) SetMaxIdleConnsPerHost(n int) {
+	p.config.maxIdleConnsPerHost = n
+	p.config.updateClient()
+}
+
+// updateClient rebuilds the HTTP client of the config from its TLS and pool
+// settings, falling back to DefaultTransport when there are none. The idle
+// connections of the transport it replaces are closed.
+func (c *Config) updateClient() {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	if c.tlsConfig == nil && !c.insecureSkipVerify && c.maxIdleConnsPerHost == 0 {
+		c.client, c.transport = nil, nil
+		return
+	}
+	t, ok := DefaultTransport.(*http.Transport)
+	if ok {
+		t = t.Clone()
+	} else {
+		t = newDefaultTransport()
+	}
+	if c.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.maxIdleConnsPerHost
+	}
+	if c.tlsConfig != nil || c.insecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{}
+		if c.tlsConfig != nil {
+			t.TLSClientConfig = c.tlsConfig.Clone()
+		}
+		if c.insecureSkipVerify {
+			t.TLSClientConfig.InsecureSkipVerify = true
+		}
+	}
+	c.client = &http.Client{Transport: &guardTransport{base: t, config: c}}
+	c.transport = t
+}
+
+// guardTransport checks the requests of a config's client against its
+// transport security settings before sending them with base. The checks
+// thus hold for every URL requested through the client, however it was
+// set, configured, discovered or linked to.
+type guardTransport struct {
+	base   http.RoundTripper
+	config *Config
+}
+
+func (g *guardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The query may hold a token; leave it out of errors.
+	endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	err := g.config.checkEndpoints(endpoint)
+	if err == nil {
+		err = g.config.checkSkipVerify(endpoint)
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &refusedError{err: err}
+	}
+	return g.base.RoundTrip(req)
+}
+
+// refusedError is the error of a request guardTransport refused to send.
+// It is not a failure of the server.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+
+func (e *refusedError) Unwrap() error { return e.err }
+
+// AllowInsecureRemote lets InsecureSkipVerify be enabled even when the
+// endpoints are https URLs on non-loopback hosts.
+func (p *Provider) AllowInsecureRemote(allow bool) {
+	p.config.allowInsecureRemote = allow
+}
+
+// isRemoteHTTPS reports whether endpoint is an https URL whose host is not
+// a loopback address.
+func isRemoteHTTPS(endpoint string) (bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false, err
+	}
+	return u.Scheme == "https" && !isLoopback(u.Hostname()), nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
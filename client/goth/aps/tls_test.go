@@ -0,0 +1,198 @@
+package aps
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestInsecureSkipVerifyLoopback(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"42"}`)
+	}))
+	defer srv.Close()
+
+	p := NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/userinfo")
+	if _, err := p.FetchUserByToken(context.Background(), "token"); err == nil {
+		t.Fatal("self-signed certificate was accepted")
+	}
+	if err := p.InsecureSkipVerify(true); err != nil {
+		t.Fatal(err)
+	}
+	user, err := p.FetchUserByToken(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "42" {
+		t.Errorf("UserID = %q, want 42", user.UserID)
+	}
+}
+
+func TestInsecureSkipVerifyRemote(t *testing.T) {
+	p := NewCustomisedURL("id", "secret", "http://localhost/callback",
+		"https://auth.example.com/authorize", "https://auth.example.com/token", "https://auth.example.com/userinfo")
+	if err := p.InsecureSkipVerify(true); err == nil {
+		t.Fatal("skip verify was enabled for remote endpoints")
+	}
+	p.AllowInsecureRemote(true)
+	if err := p.InsecureSkipVerify(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsecureSkipVerifyEndpointChanges(t *testing.T) {
+	p := NewCustomisedURL("id", "secret", "http://localhost/callback",
+		"https://localhost/authorize", "https://localhost/token", "https://localhost/userinfo")
+	if err := p.InsecureSkipVerify(true); err != nil {
+		t.Fatal(err)
+	}
+
+	err := p.SetEndpoints("https://auth.example.com/authorize", "https://auth.example.com/token", "https://auth.example.com/userinfo")
+	if err == nil {
+		t.Error("SetEndpoints accepted remote endpoints")
+	}
+	if p.config.tokenURL != "https://localhost/token" {
+		t.Errorf("token URL changed to %s", p.config.tokenURL)
+	}
+
+	// Endpoints set without an error return are refused when requested.
+	p.SetJWKSURL("https://keys.example.com/jwks")
+	if _, err := p.jwks.fetch(); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("JWKS fetch: err = %v, want a refusal", err)
+	}
+	p.SetMembershipsURL("https://api.example.com/memberships")
+	token := &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}
+	if _, err := p.FetchUserMemberships(context.Background(), token); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("memberships: err = %v, want a refusal", err)
+	}
+	if _, err := discover(p.config.httpClient(), "https://issuer.example.com"); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("discovery: err = %v, want a refusal", err)
+	}
+}
+
+// newClientCertificate returns a self-signed client certificate.
+func newClientCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert, leaf := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"at","token_type":"Bearer"}`)
+		case "/userinfo":
+			fmt.Fprint(w, `{"id":"42"}`)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	p := NewCustomisedURL("id", "secret", "http://localhost/callback", srv.URL+"/authorize", srv.URL+"/token", srv.URL+"/userinfo")
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	p.SetTLSConfig(&tls.Config{RootCAs: roots})
+	if _, err := p.FetchUserByToken(context.Background(), "at"); err == nil {
+		t.Fatal("request without a client certificate succeeded")
+	}
+
+	p.SetClientCertificate(cert)
+	if _, err := p.Exchange(context.Background(), "code"); err != nil {
+		t.Errorf("token request: %v", err)
+	}
+	user, err := p.FetchUserByToken(context.Background(), "at")
+	if err != nil {
+		t.Fatalf("userinfo request: %v", err)
+	}
+	if user.UserID != "42" {
+		t.Errorf("UserID = %q, want 42", user.UserID)
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper calling itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestSetMaxIdleConnsPerHost(t *testing.T) {
+	p, other := newTestProvider(), newTestProvider()
+	p.SetMaxIdleConnsPerHost(4)
+	if p.config.transport == nil || p.config.transport.MaxIdleConnsPerHost != 4 {
+		t.Fatalf("provider transport = %+v, want 4 idle connections per host", p.config.transport)
+	}
+	if n := DefaultTransport.(*http.Transport).MaxIdleConnsPerHost; n != defaultMaxIdleConnsPerHost {
+		t.Errorf("DefaultTransport keeps %d idle connections per host, want %d", n, defaultMaxIdleConnsPerHost)
+	}
+	if other.config.transport != nil {
+		t.Error("another provider got a transport of its own")
+	}
+	p.SetMaxIdleConnsPerHost(0)
+	if p.config.transport != nil {
+		t.Error("the provider kept its own transport without settings")
+	}
+}
+
+func TestCustomDefaultTransport(t *testing.T) {
+	defer func(saved http.RoundTripper) { DefaultTransport = saved }(DefaultTransport)
+	var requested []string
+	DefaultTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"id":"42"}`)),
+			Request:    req,
+		}, nil
+	})
+
+	p := newTestProvider()
+	if _, err := p.FetchUser(&Session{AccessToken: "at", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 {
+		t.Errorf("DefaultTransport sent %d requests, want 1", len(requested))
+	}
+	// A transport of the provider's own is tuned like the default one.
+	p.SetMaxIdleConnsPerHost(4)
+	if p.config.transport == nil || p.config.transport.IdleConnTimeout != defaultIdleConnTimeout {
+		t.Errorf("provider transport = %+v", p.config.transport)
+	}
+}
@@ -0,0 +1,41 @@
+package aps
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// tokenExchangeGrantType is the grant type of RFC 8693 token exchange.
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// accessTokenType identifies an access token as the subject token.
+	accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// ExchangeToken exchanges a user's access token for a token meant for
+// another service (OAuth 2.0 Token Exchange, RFC 8693). audience names the
+// target service; scopes, if any, narrow the scopes of the issued token.
+func (p *Provider) ExchangeToken(ctx context.Context, subjectToken, audience string, scopes ...string) (*oauth2.Token, error) {
+	v := url.Values{
+		"grant_type":         {tokenExchangeGrantType},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {accessTokenType},
+	}
+	if audience != "" {
+		v.Set("audience", audience)
+	}
+	if len(scopes) > 0 {
+		v.Set("scope", strings.Join(scopes, " "))
+	}
+	token := &oauth2.Token{}
+	ctx, span := p.config.startSpan(ctx, "aps.token_exchange", p.config.tokenURL)
+	err := p.config.updateToken(ctx, token, v)
+	endSpan(span, err)
+	if err != nil {
+		return nil, wrapError(ErrTokenExchange, err)
+	}
+	return token, nil
+}
@@ -0,0 +1,80 @@
+package aps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExchangeTokenForm(t *testing.T) {
+	var form url.Values
+	srv := tokenServer(&form)
+	defer srv.Close()
+
+	p := NewCustomisedURL("client", "secret", "http://localhost/callback", "http://localhost/authorize", srv.URL, "http://localhost/userinfo")
+	p.SetResource("https://api.example.com", "https://files.example.com")
+	token, err := p.ExchangeToken(context.Background(), "subject", "orders", "read", "write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "at" {
+		t.Errorf("AccessToken = %q", token.AccessToken)
+	}
+	want := url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {"subject"},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"audience":           {"orders"},
+		"scope":              {"read write"},
+		"resource":           {"https://api.example.com", "https://files.example.com"},
+		"client_id":          {"client"},
+		"client_secret":      {"secret"},
+	}
+	if !reflect.DeepEqual(form, want) {
+		t.Errorf("form = %v, want %v", form, want)
+	}
+
+	if _, err := p.ExchangeToken(context.Background(), "subject", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := form["audience"]; ok {
+		t.Errorf("form = %v, want no audience", form)
+	}
+	if _, ok := form["scope"]; ok {
+		t.Errorf("form = %v, want no scope", form)
+	}
+}
+
+func TestExchangeTokenErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		body   string
+		code   string
+	}{
+		{"invalid target", http.StatusBadRequest, `{"error":"invalid_target","error_description":"unknown audience"}`, "invalid_target"},
+		{"invalid subject token", http.StatusBadRequest, `{"error":"invalid_grant"}`, "invalid_grant"},
+		{"server error", http.StatusInternalServerError, `down`, ""},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		p := NewCustomisedURL("client", "secret", "http://localhost/callback", "http://localhost/authorize", srv.URL, "http://localhost/userinfo")
+		token, err := p.ExchangeToken(context.Background(), "subject", "orders")
+		srv.Close()
+		if token != nil || !errors.Is(err, ErrTokenExchange) {
+			t.Errorf("%s: token %v, err %v, want ErrTokenExchange", tt.name, token, err)
+		}
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) != (tt.code != "") || tt.code != "" && oauthErr.Code != tt.code {
+			t.Errorf("%s: err = %v, want the OAuth error %q", tt.name, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package aps
+
+import (
+	"context"
+	"net/url"
+)
+
+// Tracer starts spans around the requests the provider makes. It mirrors
+// the part of an OpenTelemetry trace.Tracer the provider needs, so an
+// adapter around one takes a few lines and this package doesn't depend on
+// OpenTelemetry.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+const (
+	// Span attributes, named after the OpenTelemetry HTTP conventions.
+	attrServerAddress = "server.address"
+	attrStatusCode    = "http.response.status_code"
+)
+
+// SetTracer makes the provider trace its token exchanges, refreshes and
+// userinfo requests with t, as children of the span in the context passed
+// to Exchange, RefreshTokenWithContext and FetchUserContext. Spans carry
+// the endpoint host and the HTTP status. Nil, the default, disables tracing.
+func (p *Provider) SetTracer(t Tracer) {
+	p.config.tracer = t
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span for a request to endpoint, or a no-op span when
+// no tracer is set. The span is kept in the returned context so the status
+// of the response can be added to it.
+func (c *Config) startSpan(ctx context.Context, name, endpoint string) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := c.tracer.Start(ctx, name)
+	if u, err := url.Parse(endpoint); err == nil {
+		span.SetAttribute(attrServerAddress, u.Hostname())
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// spanFromContext returns the span started by startSpan for ctx, or a no-op
+// span.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanContextKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
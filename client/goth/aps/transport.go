@@ -1,15 +1,51 @@
 package aps
 
 import (
+	"context"
+	"errors"
 	"golang.org/x/oauth2"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	defaultTokenType = "Bearer"
-)
+const defaultTokenType = "Bearer"
+
+// ErrTokenExpired is returned by RoundTrip when the token is expired and
+// automatic refreshing has been disabled with SetAutoRefresh(false).
+var ErrTokenExpired = errors.New("token expired")
+
+// ErrReauthRequired is returned by a transport whose refresh token was
+// rejected with invalid_grant: it can't get new tokens until the user
+// authorizes again and SetToken is called with the new token.
+var ErrReauthRequired = errors.New("refresh token is no longer valid; reauthorization required")
+
+// ErrConcurrencyLimit is returned by RoundTrip when the transport already
+// has as many requests in flight as allowed by SetMaxConcurrent and was
+// told not to wait.
+var ErrConcurrencyLimit = errors.New("too many concurrent requests")
+
+// nowFunc is the clock used for token expiry and freshness decisions.
+var nowFunc = time.Now
+
+// SetNowFunc replaces the clock used to decide whether tokens are expired or
+// due for refresh and to check id_token times, so tests can control it
+// without sleeping. It returns a function restoring the previous clock; nil
+// restores time.Now. It is not safe to call while providers or transports
+// are in use.
+func SetNowFunc(now func() time.Time) (restore func()) {
+	prev := nowFunc
+	if now == nil {
+		now = time.Now
+	}
+	nowFunc = now
+	return func() { nowFunc = prev }
+}
 
 // Expired returns true if there is no access token or the
 // access token is expired.
@@ -20,7 +56,7 @@ func Expired(t *oauth2.Token) bool {
 	if t.Expiry.IsZero() {
 		return false
 	}
-	return t.Expiry.Before(time.Now())
+	return t.Expiry.Before(nowFunc())
 }
 
 // Transport represents an authorized transport.
@@ -46,9 +82,101 @@ type Transport interface {
 	// not possible. Refresh is thread-safe.
 	RefreshToken() error
 }
+
+// RefreshController is implemented, besides Transport, by the transports of
+// this package to control how and when their token is refreshed. Transport
+// itself is left as is for the implementations and mocks of other
+// packages; assert RefreshController on it instead:
+//
+//	if rc, ok := t.(aps.RefreshController); ok {
+//		rc.SetRefreshWindow(time.Minute, 30*time.Second)
+//	}
+//
+// The transports also implement ConcurrencyLimiter and io.Closer, the
+// latter stopping the background refresh and closing idle connections.
+type RefreshController interface {
+	// Enables or disables refreshing an expired token in RoundTrip.
+	// When disabled, RoundTrip returns ErrTokenExpired instead.
+	// Auto refresh is enabled by default.
+	SetAutoRefresh(enabled bool)
+	// Makes RoundTrip refresh tokens ahead of their expiry: leeway
+	// before it, plus a random extra of up to jitter so transports
+	// sharing a token don't all refresh at the same moment.
+	SetRefreshWindow(leeway, jitter time.Duration)
+	// Sets the source the refresh window jitter is drawn from, e.g. a
+	// seeded one for reproducible tests. It is only used with the
+	// transport's lock held and must not be shared. Nil restores a
+	// source seeded with the current time.
+	SetJitterSource(rnd *rand.Rand)
+	// Sets the context refreshes run under; cancelling it aborts an
+	// in-progress refresh when the fetcher is a ContextTokenFetcher.
+	SetContext(ctx context.Context)
+	// Starts refreshing the token in the background shortly before it
+	// expires, until ctx is cancelled. Background and on-demand refreshes
+	// share the same lock, so a token is never refreshed twice.
+	StartAutoRefresh(ctx context.Context)
+	// Reports whether the refresh token was rejected with invalid_grant.
+	// A dead transport fails with ErrReauthRequired until SetToken
+	// gives it a new token.
+	IsDead() bool
+	// Makes a refresh that timed out be retried once with the same
+	// refresh token. See authorizedTransport.SetRetryRefreshOnTimeout.
+	SetRetryRefreshOnTimeout(retry bool)
+	// Sets a function called with the current token before every
+	// refresh, on demand, in RoundTrip or in the background; an error
+	// aborts the refresh and is returned instead. Nil removes it.
+	SetRefreshPolicy(policy func(old *oauth2.Token) error)
+}
+
+// ConcurrencyLimiter is implemented by the transports of this package to
+// bound the requests they have in flight; see RefreshController.
+type ConcurrencyLimiter interface {
+	// Limits the number of RoundTrip calls in progress at once to n, zero
+	// meaning no limit. Calls over the limit wait for a slot, until their
+	// request's context is done, or fail right away with
+	// ErrConcurrencyLimit when wait is false.
+	SetMaxConcurrent(n int, wait bool)
+}
+
+// TokenStore persists the token of a transport outside the process, so
+// that several instances of a service can share it.
+type TokenStore interface {
+	// Load returns the stored token, or nil if there is none.
+	Load() (*oauth2.Token, error)
+	// Save stores token, replacing any previous one.
+	Save(token *oauth2.Token) error
+}
+
 type authorizedTransport struct {
 	fetcher TokenFetcher
 	token   *oauth2.Token
+	// store, if set, holds the token instead of the token field.
+	store TokenStore
+	// ctx is the context refreshes run under; nil means Background.
+	ctx context.Context
+	// stopAutoRefresh stops the goroutine started by StartAutoRefresh,
+	// which closes autoRefreshDone when it returns.
+	stopAutoRefresh context.CancelFunc
+	autoRefreshDone chan struct{}
+	// noAutoRefresh disables refreshing expired tokens in RoundTrip.
+	noAutoRefresh bool
+	// dead is set when the refresh token was rejected with invalid_grant.
+	dead bool
+	// slots is the semaphore of SetMaxConcurrent, nil when unlimited;
+	// waitSlot makes RoundTrip wait for a slot instead of failing.
+	slots    chan struct{}
+	waitSlot bool
+	// retryOnTimeout retries a timed out refresh once.
+	retryOnTimeout bool
+	// refreshPolicy, if set, may veto refreshes.
+	refreshPolicy func(*oauth2.Token) error
+	// refreshLeeway and refreshJitter make RoundTrip refresh early; the
+	// jitter actually applied, jitterOffset, is redrawn from rnd after
+	// every refresh.
+	refreshLeeway time.Duration
+	refreshJitter time.Duration
+	jitterOffset  time.Duration
+	rnd           *rand.Rand
 	// Mutex to protect token during auto refreshments.
 	mu sync.RWMutex
 }
@@ -60,18 +188,92 @@ func NewAuthorizedTransport(fetcher TokenFetcher, token *oauth2.Token) Transport
 	return &authorizedTransport{fetcher: fetcher, token: token}
 }
 
+// NewAuthorizedTransportWithStore creates a transport like
+// NewAuthorizedTransport, but reads its token from and writes it through
+// to store instead of keeping it in memory.
+func NewAuthorizedTransportWithStore(fetcher TokenFetcher, store TokenStore) Transport {
+	return &authorizedTransport{fetcher: fetcher, store: store}
+}
+
+// AuthenticatedRequest sends a request to rawURL authorized with token,
+// such as a call to an API of the authorization server after login. The
+// token is refreshed first if it is expired; the new token is passed to the
+// OnTokenRefreshed callback, if any, so it can be saved. The caller must
+// close the response body.
+func (p *Provider) AuthenticatedRequest(ctx context.Context, token *oauth2.Token, method, rawURL string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	t := &authorizedTransport{fetcher: p.config, token: token, ctx: ctx}
+	client := &http.Client{Transport: t, CheckRedirect: sameOriginRedirect}
+	return client.Do(req)
+}
+
+// sameOriginRedirect is the redirect policy of the clients this package
+// builds around an authorized transport: redirects to another scheme or
+// host are not followed, the redirect response being returned instead.
+func sameOriginRedirect(req *http.Request, via []*http.Request) error {
+	if !sameOrigin(req.URL, via[0].URL) {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// sameOrigin reports whether a and b have the same scheme and host.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// originalRequest returns the request that led to req through redirects,
+// req itself if it wasn't redirected.
+func originalRequest(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
 // RoundTrip authorizes the request with the existing token.
 // If token is expired, tries to refresh/fetch a new token.
+// A token attached to the request context with WithToken takes precedence
+// over the transport's token; it is used as is and never refreshed.
 func (t *authorizedTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	token := t.Token()
-	if token == nil || Expired(token) {
+	release, err := t.acquireSlot(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	token, override := tokenFromContext(req.Context())
+	if !override {
+		if t.IsDead() {
+			return nil, ErrReauthRequired
+		}
+		token = t.Token()
+	}
+	if !override && t.needsRefresh(token) && t.autoRefresh() {
 		// Check if the token is refreshable.
 		// If token is refreshable, don't return an error,
 		// rather refresh.
-		if err := t.RefreshToken(); err != nil {
+		refreshed, err := t.refreshIfNeeded(0)
+		switch {
+		case err == nil:
+			token = refreshed
+		case token == nil || Expired(token):
 			return nil, err
 		}
-		token = t.Token()
+		// A failed early refresh leaves the still valid token in use.
+	}
+	if token == nil || (!override && Expired(token)) {
+		return nil, ErrTokenExpired
+	}
+	// The client following a redirect to another origin passes it here
+	// too; the token must not go there.
+	if !sameOrigin(req.URL, originalRequest(req).URL) {
+		return t.base().RoundTrip(req)
 	}
 	// To set the Authorization header, we must make a copy of the Request
 	// so that we don't modify the Request we were given.
@@ -83,44 +285,325 @@ func (t *authorizedTransport) RoundTrip(req *http.Request) (resp *http.Response,
 	}
 	req.Header.Set("Authorization", typ+" "+token.AccessToken)
 	// Make the HTTP request.
-	return DefaultTransport.RoundTrip(req)
+	return t.base().RoundTrip(req)
+}
+
+// SetMaxConcurrent limits the number of RoundTrip calls in progress at once.
+// Calls in progress when the limit changes count against the old limit.
+func (t *authorizedTransport) SetMaxConcurrent(n int, wait bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slots = nil
+	if n > 0 {
+		t.slots = make(chan struct{}, n)
+	}
+	t.waitSlot = wait
+}
+
+// SetRetryRefreshOnTimeout makes a refresh that timed out be retried once
+// with the same refresh token. The server may have processed the timed out
+// request and rotated the refresh token, in which case the retry fails with
+// invalid_grant and, as the rotated token never arrived, the transport
+// turns dead and returns ErrReauthRequired. Refreshes are thus attempted at
+// most twice and never loop; other errors are never retried. Disabled by
+// default.
+func (t *authorizedTransport) SetRetryRefreshOnTimeout(retry bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retryOnTimeout = retry
+}
+
+// SetRefreshPolicy sets a function that can veto refreshes, e.g. for audit
+// or to forbid them outside business hours. It is called with a copy of the
+// token about to be replaced, nil if there is none, with the transport's
+// lock held, so it must not call the transport.
+func (t *authorizedTransport) SetRefreshPolicy(policy func(old *oauth2.Token) error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshPolicy = policy
+}
+
+// acquireSlot takes a slot of the SetMaxConcurrent semaphore, if any, and
+// returns the function releasing it.
+func (t *authorizedTransport) acquireSlot(ctx context.Context) (release func(), err error) {
+	t.mu.RLock()
+	slots, wait := t.slots, t.waitSlot
+	t.mu.RUnlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if !wait {
+		return nil, ErrConcurrencyLimit
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Token returns the existing token that authorizes the Transport.
+// With a token store, it returns nil if the store fails to load.
 func (t *authorizedTransport) Token() *oauth2.Token {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	if t.token == nil {
+	current, err := t.loadToken()
+	if err != nil || current == nil {
 		return nil
 	}
 	token := &oauth2.Token{
-		AccessToken:  t.token.AccessToken,
-		TokenType:    t.token.TokenType,
-		RefreshToken: t.token.RefreshToken,
-		Expiry:       t.token.Expiry,
+		AccessToken:  current.AccessToken,
+		TokenType:    current.TokenType,
+		RefreshToken: current.RefreshToken,
+		Expiry:       current.Expiry,
 	}
 	return token
 }
 
 // SetToken sets a token to the transport in a thread-safe way.
+// With a token store, the token is saved to it; as SetToken cannot
+// report errors, use the store directly when a failed save matters.
 func (t *authorizedTransport) SetToken(token *oauth2.Token) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.dead = false
+	t.saveToken(token)
+}
+
+// base returns the transport requests are made with: the one of the
+// fetcher's HTTP client, with its TLS settings and checks, when it is a
+// Config, DefaultTransport otherwise.
+func (t *authorizedTransport) base() http.RoundTripper {
+	if c, ok := t.fetcher.(*Config); ok {
+		return c.httpClient().Transport
+	}
+	return DefaultTransport
+}
+
+// IsDead reports whether the refresh token was rejected with invalid_grant.
+func (t *authorizedTransport) IsDead() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.dead
+}
+
+// loadToken returns the current token from the store, if any, or from
+// memory. t.mu must be held.
+func (t *authorizedTransport) loadToken() (*oauth2.Token, error) {
+	if t.store != nil {
+		return t.store.Load()
+	}
+	return t.token, nil
+}
+
+// saveToken replaces the current token in the store, if any, or in
+// memory. t.mu must be held for writing.
+func (t *authorizedTransport) saveToken(token *oauth2.Token) error {
+	if t.store != nil {
+		return t.store.Save(token)
+	}
 	t.token = token
+	return nil
+}
+
+// SetContext sets the context token refreshes run under.
+func (t *authorizedTransport) SetContext(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ctx = ctx
+}
+
+// SetAutoRefresh enables or disables refreshing expired tokens in RoundTrip.
+func (t *authorizedTransport) SetAutoRefresh(enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.noAutoRefresh = !enabled
+}
+
+// SetRefreshWindow sets how long before expiry RoundTrip refreshes tokens.
+func (t *authorizedTransport) SetRefreshWindow(leeway, jitter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshLeeway = leeway
+	t.refreshJitter = jitter
+	t.drawJitter()
+}
+
+// SetJitterSource sets the source of the refresh window jitter and draws a
+// new jitter from it.
+func (t *authorizedTransport) SetJitterSource(rnd *rand.Rand) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rnd = rnd
+	t.drawJitter()
+}
+
+// drawJitter picks a new jitter offset. t.mu must be held for writing.
+func (t *authorizedTransport) drawJitter() {
+	t.jitterOffset = 0
+	if t.refreshJitter <= 0 {
+		return
+	}
+	if t.rnd == nil {
+		t.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	t.jitterOffset = time.Duration(t.rnd.Int63n(int64(t.refreshJitter) + 1))
+}
+
+// needsRefresh reports whether token is missing, expired, or inside the
+// refresh window before its expiry.
+func (t *authorizedTransport) needsRefresh(token *oauth2.Token) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return dueForRefresh(token, t.refreshLeeway+t.jitterOffset)
+}
+
+// dueForRefresh reports whether token is missing, expired, or expires
+// within lead.
+func dueForRefresh(token *oauth2.Token, lead time.Duration) bool {
+	if token == nil || Expired(token) {
+		return true
+	}
+	if token.Expiry.IsZero() {
+		return false
+	}
+	return !nowFunc().Before(token.Expiry.Add(-lead))
+}
+
+// refreshIfNeeded refreshes the token unless another caller already did so
+// while this one waited for the lock, so concurrent requests that find the
+// token expired cause a single refresh. The token is considered due within
+// the refresh window, or within minLead of its expiry if that is longer.
+// It returns a copy of the current token.
+func (t *authorizedTransport) refreshIfNeeded(minLead time.Duration) (*oauth2.Token, error) {
+	t.mu.Lock()
+	lead := t.refreshLeeway + t.jitterOffset
+	if minLead > lead {
+		lead = minLead
+	}
+	current, err := t.loadToken()
+	if err == nil && dueForRefresh(current, lead) {
+		err = t.refreshLocked(current)
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return t.Token(), nil
+}
+
+// Close stops the background refresh, waiting for it to return, and closes
+// the idle connections of the transport of its Config, when it has one of
+// its own; DefaultTransport, shared with other transports and providers, is
+// left alone. It is safe to call more than once and concurrently.
+func (t *authorizedTransport) Close() error {
+	t.mu.Lock()
+	stop, done := t.stopAutoRefresh, t.autoRefreshDone
+	t.stopAutoRefresh = nil
+	t.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	if done != nil {
+		<-done
+	}
+	if c, ok := t.fetcher.(*Config); ok {
+		c.closeIdleConnections()
+	}
+	return nil
+}
+
+func (t *authorizedTransport) autoRefresh() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return !t.noAutoRefresh
 }
 
 // RefreshToken retrieves a new token, if a refreshing/fetching
 // method is known and required credentials are presented
-// (such as a refresh token).
+// (such as a refresh token). A refresh token rejected with invalid_grant
+// makes the transport dead and the error ErrReauthRequired.
 func (t *authorizedTransport) RefreshToken() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	token, err := t.fetcher.FetchToken(t.token)
+	current, err := t.loadToken()
 	if err != nil {
 		return err
 	}
-	t.token = token
-	return nil
+	return t.refreshLocked(current)
+}
+
+// refreshLocked fetches a token to replace current. t.mu must be held for
+// writing.
+func (t *authorizedTransport) refreshLocked(current *oauth2.Token) error {
+	if t.dead {
+		return ErrReauthRequired
+	}
+	if t.refreshPolicy != nil {
+		var old *oauth2.Token
+		if current != nil {
+			old = &oauth2.Token{
+				AccessToken:  current.AccessToken,
+				TokenType:    current.TokenType,
+				RefreshToken: current.RefreshToken,
+				Expiry:       current.Expiry,
+			}
+		}
+		if err := t.refreshPolicy(old); err != nil {
+			return err
+		}
+	}
+	token, err := t.fetchLocked(current)
+	if err != nil && t.retryOnTimeout && isTimeout(err) && (t.ctx == nil || t.ctx.Err() == nil) {
+		token, err = t.fetchLocked(current)
+	}
+	if IsInvalidGrant(err) {
+		// Retrying won't help; the user has to authorize again.
+		t.dead = true
+		return ErrReauthRequired
+	}
+	if err != nil {
+		return err
+	}
+	t.drawJitter()
+	return t.saveToken(token)
+}
+
+// fetchLocked fetches a token to replace current with the transport's
+// fetcher. t.mu must be held.
+func (t *authorizedTransport) fetchLocked(current *oauth2.Token) (*oauth2.Token, error) {
+	if f, ok := t.fetcher.(ContextTokenFetcher); ok && t.ctx != nil {
+		return f.FetchTokenContext(t.ctx, current)
+	}
+	return t.fetcher.FetchToken(current)
+}
+
+// isTimeout reports whether err is a timeout, after which the server may or
+// may not have processed the request.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type tokenContextKey struct{}
+
+// WithToken returns a copy of ctx carrying token. Requests made with the
+// returned context through an authorized transport are authorized with token
+// instead of the transport's own, which is left untouched.
+func WithToken(ctx context.Context, token *oauth2.Token) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+func tokenFromContext(ctx context.Context) (*oauth2.Token, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(*oauth2.Token)
+	return token, ok && token != nil
 }
 
 // cloneRequest returns a clone of the provided *http.Request.
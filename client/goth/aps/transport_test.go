@@ -0,0 +1,378 @@
+package aps_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/annie2004/TestIngram/client/goth/aps"
+	"github.com/annie2004/TestIngram/client/goth/aps/apstest"
+	"golang.org/x/oauth2"
+)
+
+// authRecorder is a server recording the Authorization header of the
+// requests it receives.
+type authRecorder struct {
+	*httptest.Server
+	mu   sync.Mutex
+	auth []string
+}
+
+func newAuthRecorder(h http.HandlerFunc) *authRecorder {
+	r := &authRecorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.auth = append(r.auth, req.Header.Get("Authorization"))
+		r.mu.Unlock()
+		h(w, req)
+	}))
+	return r
+}
+
+func (r *authRecorder) headers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.auth...)
+}
+
+func validToken() *oauth2.Token {
+	return &oauth2.Token{AccessToken: "at", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+}
+
+func TestAuthenticatedRequest(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer api.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	resp, err := p.AuthenticatedRequest(context.Background(), validToken(), "GET", api.URL+"/protected", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestAuthenticatedRequestCrossHostRedirect(t *testing.T) {
+	srv := apstest.NewTestServer()
+	defer srv.Close()
+	other := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {})
+	defer other.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/protected", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, other.URL+"/steal", http.StatusFound)
+		}
+	})
+	defer api.Close()
+
+	p := srv.Provider("http://localhost/callback")
+	resp, err := p.AuthenticatedRequest(context.Background(), validToken(), "GET", api.URL+"/moved", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("same host redirect: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := api.headers(); len(got) != 2 || got[1] != "Bearer at" {
+		t.Errorf("same host redirect: Authorization headers = %q, want the token on both requests", got)
+	}
+
+	resp, err = p.AuthenticatedRequest(context.Background(), validToken(), "GET", api.URL+"/elsewhere", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("cross host redirect: status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if got := other.headers(); len(got) != 0 {
+		t.Errorf("cross host redirect was followed: %q", got)
+	}
+}
+
+func TestTransportCrossHostRedirect(t *testing.T) {
+	other := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {})
+	defer other.Close()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/steal", http.StatusFound)
+	})
+	defer api.Close()
+
+	fetcher := &apstest.StaticTokenFetcher{Token: validToken()}
+	client := &http.Client{Transport: aps.NewAuthorizedTransport(fetcher, validToken())}
+	resp, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := api.headers(); len(got) != 1 || got[0] != "Bearer at" {
+		t.Errorf("Authorization headers sent to the API = %q", got)
+	}
+	if got := other.headers(); len(got) != 1 || got[0] != "" {
+		t.Errorf("Authorization headers sent after the redirect = %q, want none", got)
+	}
+}
+
+func TestTransportOptionalInterfaces(t *testing.T) {
+	fetcher := &apstest.StaticTokenFetcher{Token: validToken()}
+	for _, tr := range []aps.Transport{
+		aps.NewAuthorizedTransport(fetcher, validToken()),
+		aps.NewAuthorizedTransportWithStore(fetcher, nil),
+	} {
+		if _, ok := tr.(aps.RefreshController); !ok {
+			t.Errorf("%T is not a RefreshController", tr)
+		}
+		if _, ok := tr.(aps.ConcurrencyLimiter); !ok {
+			t.Errorf("%T is not a ConcurrencyLimiter", tr)
+		}
+		if _, ok := tr.(io.Closer); !ok {
+			t.Errorf("%T is not an io.Closer", tr)
+		}
+	}
+}
+
+func TestTransportAutoRefreshDisabled(t *testing.T) {
+	fetcher := &apstest.StaticTokenFetcher{Token: validToken()}
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "rt", Expiry: time.Now().Add(-time.Minute)}
+	tr := aps.NewAuthorizedTransport(fetcher, expired)
+	tr.(aps.RefreshController).SetAutoRefresh(false)
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	if _, err := tr.RoundTrip(req); err != aps.ErrTokenExpired {
+		t.Errorf("err = %v, want ErrTokenExpired", err)
+	}
+	if fetcher.Calls() != 0 {
+		t.Errorf("token was refreshed %d times", fetcher.Calls())
+	}
+}
+
+func TestTransportRefreshWindowJitter(t *testing.T) {
+	const seed = 42
+	leeway, jitter := time.Minute, 2*time.Minute
+	// The first jitter the transport draws from a source with the same seed.
+	offset := time.Duration(rand.New(rand.NewSource(seed)).Int63n(int64(jitter) + 1))
+	if offset < 0 || offset > jitter {
+		t.Fatalf("jitter %v outside [0, %v]", offset, jitter)
+	}
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	restore := aps.SetNowFunc(func() time.Time { return now })
+	defer restore()
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {})
+	defer api.Close()
+
+	expiry := now.Add(10 * time.Minute)
+	fetcher := &apstest.StaticTokenFetcher{Token: &oauth2.Token{AccessToken: "new", Expiry: expiry.Add(time.Hour)}}
+	tr := aps.NewAuthorizedTransport(fetcher, &oauth2.Token{AccessToken: "old", RefreshToken: "rt", Expiry: expiry})
+	rc := tr.(aps.RefreshController)
+	rc.SetJitterSource(rand.New(rand.NewSource(seed)))
+	rc.SetRefreshWindow(leeway, jitter)
+	client := &http.Client{Transport: tr}
+	get := func() {
+		resp, err := client.Get(api.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	refreshAt := expiry.Add(-leeway - offset)
+	now = refreshAt.Add(-time.Second)
+	get()
+	if fetcher.Calls() != 0 {
+		t.Fatalf("token refreshed %v before the jittered window", refreshAt.Sub(now))
+	}
+	now = refreshAt
+	get()
+	if fetcher.Calls() != 1 {
+		t.Fatalf("token not refreshed at the start of the jittered window")
+	}
+	if got := api.headers(); got[1] != "Bearer new" {
+		t.Errorf("Authorization = %q, want the refreshed token", got[1])
+	}
+}
+
+func TestTransportRefreshPolicy(t *testing.T) {
+	api := newAuthRecorder(func(w http.ResponseWriter, r *http.Request) {})
+	defer api.Close()
+	fetcher := &apstest.StaticTokenFetcher{Token: validToken()}
+	expired := &oauth2.Token{AccessToken: "old", TokenType: "Bearer", RefreshToken: "rt", Expiry: time.Now().Add(-time.Minute)}
+	tr := aps.NewAuthorizedTransport(fetcher, expired)
+	rc := tr.(aps.RefreshController)
+
+	errVetoed := errors.New("refreshes are not allowed now")
+	var seen []*oauth2.Token
+	rc.SetRefreshPolicy(func(old *oauth2.Token) error {
+		seen = append(seen, old)
+		if old != nil {
+			// Changing the copy must not change the transport's token.
+			old.AccessToken = "tampered"
+		}
+		return errVetoed
+	})
+	if err := tr.RefreshToken(); err != errVetoed {
+		t.Errorf("RefreshToken: err = %v, want the veto", err)
+	}
+	client := &http.Client{Transport: tr}
+	if _, err := client.Get(api.URL); !errors.Is(err, errVetoed) {
+		t.Errorf("request: err = %v, want the veto", err)
+	}
+	if fetcher.Calls() != 0 {
+		t.Errorf("the fetcher was called %d times despite the veto", fetcher.Calls())
+	}
+	if len(api.headers()) != 0 {
+		t.Error("a request was sent with the expired token")
+	}
+	if len(seen) != 2 || seen[0] == expired || seen[0].RefreshToken != "rt" {
+		t.Fatalf("policy saw %v, want copies of the expired token", seen)
+	}
+	if token := tr.Token(); token.AccessToken != "old" {
+		t.Errorf("Token() = %v; the policy changed the transport's token", token)
+	}
+
+	rc.SetRefreshPolicy(nil)
+	resp, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if fetcher.Calls() != 1 {
+		t.Errorf("the token was refreshed %d times after removing the policy, want 1", fetcher.Calls())
+	}
+	if got := api.headers(); len(got) != 1 || got[0] != "Bearer at" {
+		t.Errorf("Authorization = %q, want the refreshed token", got)
+	}
+}
+
+// autoRefreshLoops returns how many auto-refresh goroutines are running.
+func autoRefreshLoops() int {
+	buf := make([]byte, 1<<20)
+	return bytes.Count(buf[:runtime.Stack(buf, true)], []byte("autoRefreshLoop("))
+}
+
+func TestTransportCloseStopsAutoRefresh(t *testing.T) {
+	before := autoRefreshLoops()
+	fetcher := &apstest.StaticTokenFetcher{Token: validToken()}
+	tr := aps.NewAuthorizedTransport(fetcher, validToken())
+	tr.(aps.RefreshController).StartAutoRefresh(context.Background())
+	for i := 0; autoRefreshLoops() == before; i++ {
+		if i == 100 {
+			t.Fatal("the auto-refresh goroutine did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.(io.Closer).Close()
+		}()
+	}
+	wg.Wait()
+	if n := autoRefreshLoops(); n != before {
+		t.Errorf("%d auto-refresh goroutines after Close, want %d", n, before)
+	}
+}
+
+func TestSetMaxConcurrent(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer api.Close()
+
+	tr := aps.NewAuthorizedTransport(&apstest.StaticTokenFetcher{Token: validToken()}, validToken())
+	tr.(aps.ConcurrencyLimiter).SetMaxConcurrent(2, true)
+	client := &http.Client{Transport: tr}
+	get := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", api.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() { errs <- get(context.Background()) }()
+	}
+	for i := 0; i < 2; i++ {
+		<-entered
+	}
+	select {
+	case <-entered:
+		t.Fatal("a third request was sent over the limit of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A waiter gives up when its context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter := make(chan error, 1)
+	go func() { waiter <- get(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled waiter: err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cancelled waiter is still waiting")
+	}
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if n := len(entered); n != 2 {
+		t.Errorf("%d more requests were sent, want the 2 that waited", n)
+	}
+}
+
+func TestSetMaxConcurrentNoWait(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	defer api.Close()
+	defer close(release)
+
+	tr := aps.NewAuthorizedTransport(&apstest.StaticTokenFetcher{Token: validToken()}, validToken())
+	tr.(aps.ConcurrencyLimiter).SetMaxConcurrent(1, false)
+	client := &http.Client{Transport: tr}
+	go client.Get(api.URL)
+	<-entered
+	if _, err := client.Get(api.URL); !errors.Is(err, aps.ErrConcurrencyLimit) {
+		t.Errorf("err = %v, want ErrConcurrencyLimit", err)
+	}
+}
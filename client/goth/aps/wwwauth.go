@@ -0,0 +1,184 @@
+package aps
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UserInfoAuthError is returned by FetchUser when the userinfo endpoint
+// rejects the access token with a 401 or 403. Code and Description come
+// from the error and error_description parameters of the WWW-Authenticate
+// header (RFC 6750), as are Realm and Scopes, and are empty if the server
+// didn't send them.
+type UserInfoAuthError struct {
+	StatusCode  int
+	Code        string
+	Description string
+	// Realm is the protection space of the userinfo endpoint.
+	Realm string
+	// Scopes are the scopes the server says the token needs, usually sent
+	// with insufficient_scope.
+	Scopes []string
+}
+
+func (e *UserInfoAuthError) Error() string {
+	msg := fmt.Sprintf("userinfo request was rejected (%d)", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// IsInvalidToken reports whether err is a userinfo rejection because the
+// access token is expired, revoked or malformed; refreshing it may help.
+func IsInvalidToken(err error) bool {
+	var authErr *UserInfoAuthError
+	return errors.As(err, &authErr) && authErr.Code == "invalid_token"
+}
+
+// IsInsufficientScope reports whether err is a userinfo rejection because
+// the access token lacks a scope; the user has to consent again.
+func IsInsufficientScope(err error) bool {
+	var authErr *UserInfoAuthError
+	return errors.As(err, &authErr) && authErr.Code == "insufficient_scope"
+}
+
+// newUserInfoAuthError builds the error for a rejected userinfo response.
+func newUserInfoAuthError(r *http.Response) *UserInfoAuthError {
+	params := parseBearerChallenge(r.Header.Values("WWW-Authenticate"))
+	return &UserInfoAuthError{
+		StatusCode:  r.StatusCode,
+		Code:        params["error"],
+		Description: params["error_description"],
+		Realm:       params["realm"],
+		Scopes:      strings.Fields(params["scope"]),
+	}
+}
+
+// parseBearerChallenge returns the parameters of the Bearer challenge found
+// in the WWW-Authenticate header values, or nil if there is none.
+func parseBearerChallenge(headers []string) map[string]string {
+	for _, h := range headers {
+		for _, c := range parseChallenges(h) {
+			if strings.EqualFold(c.scheme, "Bearer") {
+				return c.params
+			}
+		}
+	}
+	return nil
+}
+
+// challenge is one authentication challenge of a WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	// params are the auth-params by lowercased name.
+	params map[string]string
+}
+
+// parseChallenges parses a WWW-Authenticate header value, which is a comma
+// separated list of challenges, each a scheme followed by a token68, which
+// is skipped, or by comma separated name=value auth-params whose values are
+// tokens or quoted strings (RFC 7235 section 4.1). Malformed input ends the
+// parsing; the challenges read until then are returned.
+func parseChallenges(h string) []challenge {
+	var challenges []challenge
+	s := h
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		scheme, rest := readToken(s)
+		if scheme == "" {
+			return challenges
+		}
+		c := challenge{scheme: scheme, params: map[string]string{}}
+		s = strings.TrimLeft(rest, " \t")
+		if _, rest, ok := readToken68(s); ok {
+			challenges = append(challenges, c)
+			s = rest
+			continue
+		}
+		for {
+			// A name followed by "=" is a parameter of this challenge;
+			// anything else starts the next challenge.
+			name, rest := readToken(s)
+			rest = strings.TrimLeft(rest, " \t")
+			if name == "" || !strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "==") {
+				break
+			}
+			value, rest, ok := readParamValue(strings.TrimLeft(rest[1:], " \t"))
+			if !ok {
+				return append(challenges, c)
+			}
+			c.params[strings.ToLower(name)] = value
+			s = strings.TrimLeft(rest, " \t")
+			if !strings.HasPrefix(s, ",") {
+				break
+			}
+			s = strings.TrimLeft(s, " \t,")
+		}
+		challenges = append(challenges, c)
+	}
+}
+
+// readParamValue reads a token or quoted-string value from the start of s.
+func readParamValue(s string) (value, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		value, rest = readToken(s)
+		return value, rest, value != ""
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	// Unterminated quoted-string.
+	return "", "", false
+}
+
+// readToken68 reads a token68, such as base64 credentials, from the start of
+// s. It must be all of the challenge, so be followed by a comma or the end.
+func readToken68(s string) (token68, rest string, ok bool) {
+	i := 0
+	for i < len(s) && (isAlphaNum(s[i]) || strings.IndexByte("-._~+/", s[i]) >= 0) {
+		i++
+	}
+	if i == 0 {
+		return "", s, false
+	}
+	for i < len(s) && s[i] == '=' {
+		i++
+	}
+	rest = strings.TrimLeft(s[i:], " \t")
+	if rest != "" && rest[0] != ',' {
+		return "", s, false
+	}
+	return s[:i], rest, true
+}
+
+// readToken reads an RFC 7230 token from the start of s.
+func readToken(s string) (token, rest string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isTokenChar(c byte) bool {
+	return isAlphaNum(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isAlphaNum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
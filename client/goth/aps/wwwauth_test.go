@@ -0,0 +1,79 @@
+package aps
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		headers []string
+		want    map[string]string
+	}{
+		{
+			"quoted error",
+			[]string{`Bearer error="invalid_token", error_description="The access token expired"`},
+			map[string]string{"error": "invalid_token", "error_description": "The access token expired"},
+		},
+		{
+			"unquoted error",
+			[]string{`Bearer error=insufficient_scope, scope="read write"`},
+			map[string]string{"error": "insufficient_scope", "scope": "read write"},
+		},
+		{
+			"quoted-string escapes",
+			[]string{`Bearer error="invalid_token", error_description="say \"hi\", \\ bye"`},
+			map[string]string{"error": "invalid_token", "error_description": `say "hi", \ bye`},
+		},
+		{
+			"case-insensitive scheme and names",
+			[]string{`bearer Error="invalid_token"`},
+			map[string]string{"error": "invalid_token"},
+		},
+		{
+			"bare scheme",
+			[]string{`Bearer`},
+			map[string]string{},
+		},
+		{
+			"token68 challenge first",
+			[]string{`Negotiate YIIB9wYGKwYBBQUCoIIB6zCCAeeg==, Bearer error="invalid_token"`},
+			map[string]string{"error": "invalid_token"},
+		},
+		{
+			"several challenges in one header",
+			[]string{`Basic realm="basic, realm", charset="UTF-8", Bearer realm="api", error="invalid_token"`},
+			map[string]string{"realm": "api", "error": "invalid_token"},
+		},
+		{
+			"several headers",
+			[]string{`Basic realm="basic"`, `Bearer error="insufficient_scope"`},
+			map[string]string{"error": "insufficient_scope"},
+		},
+		{
+			"no bearer challenge",
+			[]string{`Basic realm="basic"`},
+			nil,
+		},
+		{
+			"no header",
+			nil,
+			nil,
+		},
+		{
+			"unterminated quoted-string",
+			[]string{`Bearer error="invalid_token", error_description="never ends`},
+			map[string]string{"error": "invalid_token"},
+		},
+		{
+			"garbage",
+			[]string{`=== ,,, "`},
+			nil,
+		},
+	} {
+		if got := parseBearerChallenge(tt.headers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseBearerChallenge(%q) = %v, want %v", tt.name, tt.headers, got, tt.want)
+		}
+	}
+}